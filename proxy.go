@@ -3,18 +3,45 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"golang.org/x/net/http2"
 )
 
@@ -25,34 +52,798 @@ const (
 	deepseekOpenRouterModel = "deepseek/deepseek-chat"
 	deepseekChatModel       = "deepseek-chat"
 	deepseekCoderModel      = "deepseek-coder"
+	deepseekReasonerModel   = "deepseek-reasoner"
 	gpt4oModel              = "gpt-4o"
 )
 
 var (
 	deepseekAPIKey   string
 	openRouterAPIKey string
+
+	// OpenRouter attribution headers for clients without their own
+	openRouterReferer string
+	openRouterTitle   string
+
+	// Upstreams to choose between by recent health (empty disables)
+	healthAwareUpstreams []string
+	upstreamMaxErrorRate float64
+
+	// Fail startup if the upstream cannot be reached
+	startupProbe bool
+	// Timeout for calls to the upstream /models endpoint (probes and warm-ups)
+	modelsTimeout time.Duration
+	// Timeout for non-streaming upstream completions, including reading the response
+	completionTimeout time.Duration
+	// Keep an upstream connection warm by calling /models at this interval (0 disables)
+	warmupInterval time.Duration
+
+	// Directory where raw request bodies are captured for later replay
+	captureDir string
+
+	// Directory where redacted request/response pairs are recorded for replay tests
+	recordDir string
+	// Captured request to run through the conversion pipeline instead of serving
+	replayFile string
+	// Sequence number used to keep capture file names unique
+	captureSeq uint64
+
+	// Salted hashes of the accepted client keys (CLIENT_KEY_HASHES)
+	clientKeyHashes []keyHash
+
+	// How to answer upstream responses without choices: "content_filter" or "error"
+	emptyChoicesMode string
+
+	// What to do with repeated tool call IDs in one message: "rename", "dedupe" or "keep"
+	duplicateToolCallIDs string
+
+	// Initial retry: directive sent to SSE clients in milliseconds (0 disables)
+	sseRetryMillis int
+
+	// Maximum duration of a stream before it is finished with the partial answer (0 disables)
+	streamTimeout time.Duration
+
+	// Minimum delay between streamed chunks to pace output (0 disables)
+	streamChunkDelay time.Duration
+
+	// How streamed events are flushed: "immediate" or "batched" (up to STREAM_FLUSH_BYTES
+	// or STREAM_FLUSH_INTERVAL_MS); clients pick their own with X-Stream-Flush
+	streamFlush         string
+	streamFlushBytes    int
+	streamFlushInterval time.Duration
+
+	// Report upstream errors of streaming requests as SSE error events on a 200 response
+	streamErrorEvents bool
+
+	// Language of proxy error messages when Accept-Language has no supported match
+	defaultErrorLanguage = "en"
+
+	// Maximum size of a single upstream stream line (0 disables the limit)
+	maxStreamLineBytes int
+
+	// Maximum size of a non-streaming upstream response (0 disables the limit)
+	maxResponseBytes int
+
+	// Requests slower than this get a detailed summary log line (0 disables summaries)
+	slowRequestThreshold time.Duration
+
+	// Stores non-streaming responses by Idempotency-Key (nil when disabled)
+	idempotencyCache *responseCache
+
+	// Bearer token for the /admin/ endpoints (unset disables them)
+	adminToken string
+
+	// Tokens each client key may use per quota window (nil store when disabled)
+	tokenQuota int
+	quotaStore QuotaStore
+
+	// Send a second identical non-streaming request if the first is slower than this (0 disables)
+	hedgeDelay time.Duration
+
+	// Switch non-streaming requests to SSE when the upstream takes longer than this (0 disables)
+	streamUpgradeAfter time.Duration
+
+	// Retries for streaming requests that fail before the first byte
+	streamSetupRetries    int
+	streamSetupRetryDelay time.Duration
+	// Full-jitter exponential backoff instead of a fixed delay, and the total time budget
+	// after which retries stop (0 disables)
+	retryJitter     bool
+	retryMaxElapsed time.Duration
+
+	// Send CORS headers (disable when the proxy is only used server-side)
+	corsEnabled bool
+	// How long browsers may cache a preflight response, in seconds
+	corsMaxAge int
+
+	// Send HSTS on HTTPS requests and redirect plain-HTTP requests to HTTPS
+	hstsEnabled bool
+
+	// Return the upstream's request ID in X-Upstream-Request-ID
+	exposeUpstreamRequestID bool
+
+	// Prompt logging: "off", "full" or "redacted", the sampled share and the sink
+	logPrompts       string
+	promptSampleRate float64
+	promptSink       PromptSink
+
+	// Checking of JSON mode answers: "off", "annotate" or "retry"
+	jsonModeValidation string
+
+	// Webhook that may rewrite each request body before it is forwarded, its timeout and
+	// whether requests fail ("closed") or pass through unchanged ("open") when it errors
+	requestWebhookURL      string
+	requestWebhookTimeout  time.Duration
+	requestWebhookFailMode string
+
+	// Conversations above this many estimated tokens get their oldest messages summarized (0 disables)
+	conversationTokenBudget int
+
+	// Upstream models the proxy refuses to use
+	blockedModels map[string]bool
+
+	// Model variants of the A/B experiment, bucketed by user or client key
+	experimentVariants []experimentVariant
+
+	// Joins the content of consecutive same-role messages merged with MERGE_MESSAGES
+	messageMergeSeparator string
+
+	// System message injected per model when the client sends none
+	defaultSystemMessages map[string]string
+
+	// Answer with canned completions instead of calling the upstream (for load testing)
+	fakeUpstream bool
+
+	// Prompts estimated above this many tokens switch to the large-context model (0 disables)
+	largeContextThreshold int
+	largeContextModel     string
+	largeContextProvider  string
+
+	// Token-range routing rules (MODEL_ROUTING_RULES), checked before the large-context switch
+	routingRules []routingRule
+
+	// Models for requests with and without tools (TOOLS_MODEL, NO_TOOLS_MODEL); empty keeps the model
+	toolsTarget   modelTarget
+	noToolsTarget modelTarget
+
+	// Limits for /v1/chat/completions/batch
+	batchMaxSize     int
+	batchConcurrency int
+
+	// Serve Anthropic Messages API requests on /v1/messages
+	anthropicMessages bool
+
+	// Maximum number of tools per request (0 disables the limit)
+	maxTools int
+
+	// Longest body written to the logs (0 logs bodies in full)
+	logBodyMaxBytes int
+	// Indent logged JSON bodies in debug mode
+	debugPretty bool
+
+	// Accept-Language sent upstream when the client sends none
+	defaultAcceptLanguage string
+
+	// Reject requests that do not set max_tokens
+	requireMaxTokens bool
+
+	// Limits on the client header set (0 disables a limit)
+	maxHeaderCount int
+	maxHeaderBytes int
 )
 
 // Configuration structure
 type Config struct {
+	name     string
 	endpoint string
 	model    string
 	apiKey   string
+	// Client path prefix to drop because the endpoint already carries its own version prefix
+	stripPrefix string
+	// OpenRouter attribution headers (empty uses OPENROUTER_REFERER / OPENROUTER_TITLE)
+	referer string
+	title   string
+	// Stream flush strategy for this client (empty uses STREAM_FLUSH)
+	flush string
 }
 
 var activeConfig Config
 
-// Global HTTP client with optimized settings
-var httpClient = &http.Client{
-	Transport: &http2.Transport{
+// Process start time, used as the stable creation time of listed models
+var startTime = time.Now()
+
+// Build version, set with -ldflags "-X main.version=..."; otherwise taken from the build info
+var version string
+
+// buildVersion returns the version reported in X-Proxy-Version
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				return setting.Value[:12]
+			}
+		}
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+	}
+	return "dev"
+}
+
+// providers lists the upstream configurations selectable by name
+var providers = map[string]Config{
+	"chat": {
+		endpoint: deepseekEndpoint,
+		model:    deepseekChatModel,
+	},
+	"coder": {
+		endpoint:    deepseekBetaEndpoint,
+		model:       deepseekCoderModel,
+		stripPrefix: "/v1",
+	},
+	"openrouter": {
+		endpoint:    openRouterEndpoint,
+		model:       deepseekOpenRouterModel,
+		stripPrefix: "/v1",
+	},
+	"reasoner": {
+		endpoint: deepseekEndpoint,
+		model:    deepseekReasonerModel,
+	},
+}
+
+// modelFlag returns the provider selected with -model, falling back to chat
+func modelFlag(args []string) string {
+	model := "chat" // default value
+	for i, arg := range args {
+		if arg == "-model" && i+1 < len(args) {
+			model = args[i+1]
+		}
+	}
+	if _, ok := providers[model]; !ok {
+		log.Printf("Invalid model specified: %s. Using default chat model.", model)
+		model = "chat"
+	}
+	return model
+}
+
+// providerConfig returns the named upstream configuration with its API key filled in
+func providerConfig(name string) (Config, error) {
+	cfg, ok := providers[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown provider: %s", name)
+	}
+	cfg.name = name
+
+	switch cfg.endpoint {
+	case openRouterEndpoint:
+		if openRouterAPIKey == "" {
+			return Config{}, fmt.Errorf("OPENROUTER_API_KEY is required for %s model", name)
+		}
+		cfg.apiKey = openRouterAPIKey
+	default:
+		if deepseekAPIKey == "" {
+			return Config{}, fmt.Errorf("DEEPSEEK_API_KEY is required for %s model", name)
+		}
+		cfg.apiKey = deepseekAPIKey
+	}
+	return cfg, nil
+}
+
+// upstreamAliases maps X-Upstream header values onto provider names
+var upstreamAliases = map[string]string{
+	"deepseek":   "chat",
+	"chat":       "chat",
+	"coder":      "coder",
+	"openrouter": "openrouter",
+	"reasoner":   "reasoner",
+}
+
+// selectUpstream resolves an X-Upstream header value to a configured provider
+func selectUpstream(name string) (Config, error) {
+	provider, ok := upstreamAliases[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown upstream %q", name)
+	}
+	cfg, err := providerConfig(provider)
+	if err != nil {
+		return Config{}, fmt.Errorf("upstream %q is not configured", name)
+	}
+	return cfg, nil
+}
+
+// healthWindow is the number of recent results kept per upstream
+const healthWindow = 20
+
+// upstreamHealth tracks recent request outcomes per upstream
+type upstreamHealth struct {
+	mu      sync.Mutex
+	results map[string][]bool
+}
+
+var upstreamStats = &upstreamHealth{results: make(map[string][]bool)}
+
+// record stores the outcome of one upstream request
+func (h *upstreamHealth) record(name string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	results := append(h.results[name], ok)
+	if len(results) > healthWindow {
+		results = results[len(results)-healthWindow:]
+	}
+	h.results[name] = results
+}
+
+// errorRate returns the share of failed recent requests (0 when there is no history)
+func (h *upstreamHealth) errorRate(name string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	results := h.results[name]
+	if len(results) == 0 {
+		return 0
+	}
+	failures := 0
+	for _, ok := range results {
+		if !ok {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(results))
+}
+
+// selectHealthyUpstream returns the first upstream in preference order whose recent
+// error rate is below UPSTREAM_MAX_ERROR_RATE, or the least failing one if none is
+func selectHealthyUpstream(names []string) Config {
+	best, bestRate := "", 2.0
+	for _, name := range names {
+		rate := upstreamStats.errorRate(name)
+		if rate < upstreamMaxErrorRate {
+			best = name
+			break
+		}
+		if rate < bestRate {
+			best, bestRate = name, rate
+		}
+	}
+
+	cfg, err := providerConfig(best)
+	if err != nil {
+		log.Printf("Error selecting upstream %s: %v", best, err)
+		return activeConfig
+	}
+	if best != names[0] {
+		log.Printf("Preferred upstream %s is unhealthy (error rate %.2f), using %s", names[0], upstreamStats.errorRate(names[0]), best)
+	}
+	return cfg
+}
+
+// ConfigResolver maps a validated client bearer token to the upstream configuration to use
+type ConfigResolver interface {
+	Resolve(token string) (Config, bool)
+}
+
+// staticResolver accepts only the active upstream key and always routes to the active config
+type staticResolver struct{}
+
+func (staticResolver) Resolve(token string) (Config, bool) {
+	// With CLIENT_KEY_HASHES set, only tokens matching one of the hashes are accepted
+	if len(clientKeyHashes) > 0 {
+		for _, h := range clientKeyHashes {
+			if h.matches(token) {
+				return activeConfig, true
+			}
+		}
+		return Config{}, false
+	}
+	if token != activeConfig.apiKey {
+		return Config{}, false
+	}
+	return activeConfig, true
+}
+
+// keyHashPrefix marks a client key stored as "sha256$<salt>$<digest>" (both hex encoded)
+const keyHashPrefix = "sha256$"
+
+// keyHash is a salted SHA-256 digest of a client key
+type keyHash struct {
+	salt   []byte
+	digest []byte
+}
+
+// parseKeyHash decodes a "sha256$<salt>$<digest>" string
+func parseKeyHash(s string) (keyHash, error) {
+	saltHex, digestHex, found := strings.Cut(strings.TrimPrefix(s, keyHashPrefix), "$")
+	if !strings.HasPrefix(s, keyHashPrefix) || !found {
+		return keyHash{}, fmt.Errorf("invalid key hash %q (expected sha256$<salt>$<digest>)", truncateString(s, 12))
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil || len(salt) == 0 {
+		return keyHash{}, fmt.Errorf("invalid key hash salt in %q", truncateString(s, 12))
+	}
+	digest, err := hex.DecodeString(digestHex)
+	if err != nil || len(digest) != sha256.Size {
+		return keyHash{}, fmt.Errorf("invalid key hash digest in %q", truncateString(s, 12))
+	}
+	return keyHash{salt: salt, digest: digest}, nil
+}
+
+// matches reports whether token hashes to h, comparing in constant time
+func (h keyHash) matches(token string) bool {
+	return subtle.ConstantTimeCompare(saltedDigest(h.salt, token), h.digest) == 1
+}
+
+func saltedDigest(salt []byte, token string) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), token...))
+	return sum[:]
+}
+
+// hashClientKey returns a new salted hash of a client key for CLIENT_KEY_HASHES or TENANTS_FILE
+func hashClientKey(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := crand.Read(salt); err != nil {
+		return "", err
+	}
+	return keyHashPrefix + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedDigest(salt, token)), nil
+}
+
+// tenantEntry describes one tenant in the TENANTS_FILE mapping
+type tenantEntry struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+	APIKey   string `json:"api_key,omitempty"`
+	Referer  string `json:"referer,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Flush    string `json:"flush,omitempty"`
+}
+
+// tenantResolver routes each client key to its own upstream configuration
+type tenantResolver struct {
+	tenants map[string]Config
+	hashed  []hashedTenant
+}
+
+// hashedTenant is a tenant whose client key is stored as a salted hash
+type hashedTenant struct {
+	hash keyHash
+	cfg  Config
+}
+
+func (t *tenantResolver) Resolve(token string) (Config, bool) {
+	if cfg, ok := t.tenants[token]; ok {
+		return cfg, true
+	}
+	for _, tenant := range t.hashed {
+		if tenant.hash.matches(token) {
+			return tenant.cfg, true
+		}
+	}
+	return Config{}, false
+}
+
+// loadTenants reads a JSON object mapping client keys to tenant entries
+func loadTenants(path string) (*tenantResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants file: %w", err)
+	}
+
+	var entries map[string]tenantEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file: %w", err)
+	}
+
+	resolver := &tenantResolver{tenants: make(map[string]Config, len(entries))}
+	for clientKey, entry := range entries {
+		cfg, ok := providers[entry.Provider]
+		if !ok {
+			return nil, fmt.Errorf("tenant %s: unknown provider %q", truncateString(clientKey, 4), entry.Provider)
+		}
+		if entry.APIKey != "" {
+			cfg.name = entry.Provider
+			cfg.apiKey = entry.APIKey
+		} else if cfg, err = providerConfig(entry.Provider); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", truncateString(clientKey, 4), err)
+		}
+		if entry.Model != "" {
+			cfg.model = entry.Model
+		}
+		if entry.Endpoint != "" {
+			cfg.endpoint = entry.Endpoint
+		}
+		cfg.referer = entry.Referer
+		cfg.title = entry.Title
+		if entry.Flush != "" && !validFlushStrategy(entry.Flush) {
+			return nil, fmt.Errorf("tenant %s: invalid flush %q (expected immediate or batched)", truncateString(clientKey, 4), entry.Flush)
+		}
+		cfg.flush = entry.Flush
+		if strings.HasPrefix(clientKey, keyHashPrefix) {
+			hash, err := parseKeyHash(clientKey)
+			if err != nil {
+				return nil, err
+			}
+			resolver.hashed = append(resolver.hashed, hashedTenant{hash: hash, cfg: cfg})
+			continue
+		}
+		resolver.tenants[clientKey] = cfg
+	}
+	return resolver, nil
+}
+
+// configResolver selects the upstream configuration for each request
+var configResolver ConfigResolver = staticResolver{}
+
+// Authenticator identifies the client of a request and picks its upstream configuration.
+// The returned identity keys per-client state such as quotas and idempotency keys
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, cfg Config, err error)
+}
+
+var (
+	errMissingCredentials = errors.New("Missing or invalid Authorization header")
+	errInvalidCredentials = errors.New("Invalid API key")
+)
+
+// keyAuthenticator accepts static bearer keys, resolved through configResolver
+type keyAuthenticator struct{}
+
+func (keyAuthenticator) Authenticate(r *http.Request) (string, Config, error) {
+	token, ok := parseBearer(r.Header.Get("Authorization"))
+	if !ok {
+		return "", Config{}, errMissingCredentials
+	}
+	cfg, ok := configResolver.Resolve(token)
+	if !ok {
+		return "", Config{}, errInvalidCredentials
+	}
+	return token, cfg, nil
+}
+
+// jwtAuthenticator accepts HMAC-signed JWTs that have not expired and, when configured,
+// carry the expected audience and issuer; every client uses the active config
+type jwtAuthenticator struct {
+	secret   []byte
+	audience string
+	issuer   string
+}
+
+// jwtHashes are the accepted signing algorithms; "none" and asymmetric algorithms are rejected
+var jwtHashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+func (a jwtAuthenticator) Authenticate(r *http.Request) (string, Config, error) {
+	token, ok := parseBearer(r.Header.Get("Authorization"))
+	if !ok {
+		return "", Config{}, errMissingCredentials
+	}
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		log.Printf("Rejected JWT: %v", err)
+		return "", Config{}, errInvalidCredentials
+	}
+	identity := claims.Subject
+	if identity == "" {
+		identity = token
+	}
+	return identity, activeConfig, nil
+}
+
+// jwtClaims are the registered claims the proxy checks; aud may be a string or a list
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// verify checks a token's signature and claims at the given time
+func (a jwtAuthenticator) verify(token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return claims, errors.New("malformed header")
+	}
+	newHash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return claims, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed signature")
+	}
+	mac := hmac.New(newHash, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return claims, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed claims")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed claims")
+	}
+	unix := float64(now.Unix())
+	if claims.ExpiresAt == nil {
+		return claims, errors.New("missing exp claim")
+	}
+	if unix >= *claims.ExpiresAt {
+		return claims, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && unix < *claims.NotBefore {
+		return claims, errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return claims, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if a.audience != "" && !hasAudience(claims.Audience, a.audience) {
+		return claims, errors.New("audience not allowed")
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether a JWT aud claim, a string or a list of strings, includes want
+func hasAudience(raw json.RawMessage, want string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == want
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) != nil {
+		return false
+	}
+	for _, aud := range list {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks client credentials, selected with AUTH_MODE
+var authenticator Authenticator = keyAuthenticator{}
+
+// Global HTTP client with optimized settings. It has no overall timeout, which would also cut
+// off long streams; each route bounds its requests through the context instead
+// (COMPLETION_TIMEOUT_SECONDS, MODELS_TIMEOUT_MS, STREAM_TIMEOUT_MS), all of which default to
+// a limit.
+var httpClient = &http.Client{}
+
+// connStats counts how upstream requests obtain their connections
+var connStats struct {
+	opened   atomic.Int64 // requests that needed a new connection
+	reused   atomic.Int64 // requests served on an existing connection
+	idle     atomic.Int64 // reused connections that were idle at the time
+	inFlight atomic.Int64 // requests waiting for response headers
+	inUse    atomic.Int64 // requests holding a connection until their response body is closed
+}
+
+// requestStats counts the requests handled by proxyHandler, for /admin/stats
+var requestStats struct {
+	total    atomic.Int64
+	inFlight atomic.Int64
+	errors   atomic.Int64 // answered with a 4xx or 5xx status
+}
+
+// runtimeStats summarizes the process and requestStats for the admin endpoint
+func runtimeStats() map[string]interface{} {
+	return map[string]interface{}{
+		"goroutines":         runtime.NumGoroutine(),
+		"requests_in_flight": requestStats.inFlight.Load(),
+		"requests_total":     requestStats.total.Load(),
+		"errors_total":       requestStats.errors.Load(),
+		"uptime_seconds":     int64(time.Since(startTime).Seconds()),
+	}
+}
+
+// instrumentedTransport records connection usage in connStats for every upstream request
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var holding atomic.Bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			// A retried request may get another connection; it still holds only one
+			if holding.CompareAndSwap(false, true) {
+				connStats.inUse.Add(1)
+			}
+			if !info.Reused {
+				connStats.opened.Add(1)
+				return
+			}
+			connStats.reused.Add(1)
+			if info.WasIdle {
+				connStats.idle.Add(1)
+			}
+		},
+	}
+	connStats.inFlight.Add(1)
+	defer connStats.inFlight.Add(-1)
+	resp, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if !holding.Load() {
+		return resp, err
+	}
+	if err != nil {
+		connStats.inUse.Add(-1)
+		return resp, err
+	}
+	resp.Body = &connReleasingBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+// connReleasingBody counts its request out of connStats.inUse when closed
+type connReleasingBody struct {
+	io.ReadCloser
+	once sync.Once
+}
+
+func (b *connReleasingBody) Close() error {
+	b.once.Do(func() { connStats.inUse.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// connectionMetrics summarizes connStats for the admin endpoint
+func connectionMetrics() map[string]interface{} {
+	opened, reused := connStats.opened.Load(), connStats.reused.Load()
+	reuseRate := 0.0
+	if total := opened + reused; total > 0 {
+		reuseRate = float64(reused) / float64(total)
+	}
+	return map[string]interface{}{
+		"connections_in_use":          connStats.inUse.Load(),
+		"connections_opened_total":    opened,
+		"connections_reused_total":    reused,
+		"idle_connections_used_total": connStats.idle.Load(),
+		"requests_in_flight":          connStats.inFlight.Load(),
+		"reuse_rate":                  reuseRate,
+	}
+}
+
+// newUpstreamTransport returns the HTTP/2 transport, or when HTTP_PROXY/HTTPS_PROXY is set a
+// standard transport that tunnels through the proxy (http2.Transport cannot use a proxy)
+// and still negotiates HTTP/2 with the upstream
+func newUpstreamTransport() http.RoundTripper {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if os.Getenv(name) != "" {
+			return &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			}
+		}
+	}
+	return &http2.Transport{
 		AllowHTTP: true,
 		DialTLS:   nil,
 		// Optimize connection pooling
 		ReadIdleTimeout:  30 * time.Second,
 		PingTimeout:      10 * time.Second,
 		WriteByteTimeout: 15 * time.Second,
-	},
-	Timeout: 5 * time.Minute,
+	}
 }
 
 var (
@@ -98,65 +889,462 @@ func init() {
 		log.Printf("Warning: .env file not found or error loading it: %v", err)
 	}
 
+	// Chosen after loading .env so its proxy settings apply too
+	transport := newUpstreamTransport()
+	if _, proxied := transport.(*http.Transport); proxied {
+		log.Printf("Sending upstream requests through the proxy from HTTP_PROXY/HTTPS_PROXY")
+	}
+	httpClient.Transport = &instrumentedTransport{base: transport}
+	version = buildVersion()
+
+	// Print a salted hash of the client key read from stdin and exit
+	for _, arg := range os.Args[1:] {
+		if arg == "-hash-key" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatalf("Error reading client key from stdin: %v", err)
+			}
+			hash, err := hashClientKey(strings.TrimSpace(line))
+			if err != nil {
+				log.Fatalf("Error hashing client key: %v", err)
+			}
+			fmt.Println(hash)
+			os.Exit(0)
+		}
+	}
+
 	// Get API keys
 	deepseekAPIKey = os.Getenv("DEEPSEEK_API_KEY")
 	openRouterAPIKey = os.Getenv("OPENROUTER_API_KEY")
 
+	// OpenRouter attribution, overridable per tenant in TENANTS_FILE
+	openRouterReferer = os.Getenv("OPENROUTER_REFERER")
+	if openRouterReferer == "" {
+		openRouterReferer = "https://github.com/danilofalcao/cursor-deepseek"
+	}
+	openRouterTitle = os.Getenv("OPENROUTER_TITLE")
+	if openRouterTitle == "" {
+		openRouterTitle = "Cursor DeepSeek"
+	}
+
 	// Ensure at least one API key is provided
 	if deepseekAPIKey == "" && openRouterAPIKey == "" {
 		log.Fatal("Either DEEPSEEK_API_KEY or OPENROUTER_API_KEY environment variable is required")
 	}
 
 	// Parse command line arguments
-	modelFlag := "chat" // default value
 	for i, arg := range os.Args {
-		if arg == "-model" && i+1 < len(os.Args) {
-			modelFlag = os.Args[i+1]
+		if arg == "-replay" && i+1 < len(os.Args) {
+			replayFile = os.Args[i+1]
 		}
 	}
 
 	// Configure the active endpoint and model based on the flag
-	switch modelFlag {
-	case "coder":
-		if deepseekAPIKey == "" {
-			log.Fatal("DEEPSEEK_API_KEY is required for coder model")
-		}
-		activeConfig = Config{
-			endpoint: deepseekBetaEndpoint,
-			model:    deepseekCoderModel,
-			apiKey:   deepseekAPIKey,
-		}
-	case "chat":
-		if deepseekAPIKey == "" {
-			log.Fatal("DEEPSEEK_API_KEY is required for chat model")
+	cfg, err := providerConfig(modelFlag(os.Args))
+	if err != nil {
+		log.Fatal(err)
+	}
+	activeConfig = cfg
+
+	log.Printf("Initialized with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
+
+	// Accept salted client key hashes instead of the upstream key
+	if hashes := os.Getenv("CLIENT_KEY_HASHES"); hashes != "" {
+		for _, entry := range strings.Split(hashes, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			hash, err := parseKeyHash(entry)
+			if err != nil {
+				log.Fatalf("Invalid CLIENT_KEY_HASHES entry: %v", err)
+			}
+			clientKeyHashes = append(clientKeyHashes, hash)
 		}
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
-			apiKey:   deepseekAPIKey,
+	}
+
+	// Optional JWT authentication instead of static client keys
+	switch mode := os.Getenv("AUTH_MODE"); mode {
+	case "", "key":
+	case "jwt":
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			log.Fatal("JWT_SECRET is required with AUTH_MODE=jwt")
 		}
-	case "openrouter":
-		if openRouterAPIKey == "" {
-			log.Fatal("OPENROUTER_API_KEY is required for openrouter model")
+		authenticator = jwtAuthenticator{
+			secret:   []byte(secret),
+			audience: os.Getenv("JWT_AUDIENCE"),
+			issuer:   os.Getenv("JWT_ISSUER"),
+		}
+		log.Printf("Authenticating clients with HMAC-signed JWTs")
+	default:
+		log.Fatalf("Invalid AUTH_MODE: %s (expected key or jwt)", mode)
+	}
+
+	// Optional per-tenant routing
+	if tenantsFile := os.Getenv("TENANTS_FILE"); tenantsFile != "" {
+		resolver, err := loadTenants(tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configResolver = resolver
+		log.Printf("Loaded %d tenants from %s", len(resolver.tenants)+len(resolver.hashed), tenantsFile)
+	}
+
+	// Optional health-aware selection between several upstreams, in preference order
+	if upstreams := os.Getenv("UPSTREAMS"); upstreams != "" {
+		for _, name := range strings.Split(upstreams, ",") {
+			name = strings.TrimSpace(name)
+			if _, err := providerConfig(name); err != nil {
+				log.Fatalf("Invalid UPSTREAMS entry: %v", err)
+			}
+			healthAwareUpstreams = append(healthAwareUpstreams, name)
+		}
+		log.Printf("Health-aware upstream selection between: %s", strings.Join(healthAwareUpstreams, ", "))
+	}
+	conversationTokenBudget = envInt("CONVERSATION_TOKEN_BUDGET", 0)
+
+	if models := os.Getenv("BLOCKED_MODELS"); models != "" {
+		blockedModels = make(map[string]bool)
+		for _, model := range strings.Split(models, ",") {
+			if model = strings.TrimSpace(model); model != "" {
+				blockedModels[model] = true
+			}
+		}
+	}
+
+	upstreamMaxErrorRate = 0.5
+	if rate := os.Getenv("UPSTREAM_MAX_ERROR_RATE"); rate != "" {
+		if v, err := strconv.ParseFloat(rate, 64); err == nil && v > 0 && v <= 1 {
+			upstreamMaxErrorRate = v
+		} else {
+			log.Printf("Invalid UPSTREAM_MAX_ERROR_RATE: %s. Using %.2f.", rate, upstreamMaxErrorRate)
+		}
+	}
+
+	// Optional features
+	startupProbe = envBool("STARTUP_PROBE", false)
+	modelsTimeout = time.Duration(envInt("MODELS_TIMEOUT_MS", 10000)) * time.Millisecond
+	completionTimeout = time.Duration(envInt("COMPLETION_TIMEOUT_SECONDS", 300)) * time.Second
+	warmupInterval = time.Duration(envInt("WARMUP_INTERVAL_SECONDS", 0)) * time.Second
+	captureDir = os.Getenv("CAPTURE_DIR")
+	if captureDir != "" {
+		if err := os.MkdirAll(captureDir, 0o700); err != nil {
+			log.Fatalf("Error creating capture directory %s: %v", captureDir, err)
+		}
+		log.Printf("Capturing request bodies to: %s", captureDir)
+	}
+	recordDir = os.Getenv("RECORD_DIR")
+	if recordDir != "" {
+		if err := os.MkdirAll(recordDir, 0o700); err != nil {
+			log.Fatalf("Error creating record directory %s: %v", recordDir, err)
+		}
+		log.Printf("Recording request/response pairs to: %s", recordDir)
+	}
+
+	streamTimeout = time.Duration(envInt("STREAM_TIMEOUT_MS", 300000)) * time.Millisecond
+	maxStreamLineBytes = envInt("MAX_STREAM_LINE_BYTES", 1<<20)
+	maxResponseBytes = envInt("MAX_RESPONSE_BYTES", 0)
+	sseRetryMillis = envInt("SSE_RETRY_MS", 0)
+	streamChunkDelay = time.Duration(envInt("STREAM_CHUNK_DELAY_MS", 0)) * time.Millisecond
+	streamErrorEvents = envBool("STREAM_ERROR_EVENTS", false)
+	streamFlush = os.Getenv("STREAM_FLUSH")
+	switch streamFlush {
+	case flushImmediate, flushBatched:
+	case "":
+		streamFlush = flushImmediate
+	default:
+		log.Printf("Invalid STREAM_FLUSH %q, using immediate", streamFlush)
+		streamFlush = flushImmediate
+	}
+	streamFlushBytes = envInt("STREAM_FLUSH_BYTES", 4096)
+	streamFlushInterval = time.Duration(envInt("STREAM_FLUSH_INTERVAL_MS", 100)) * time.Millisecond
+	if lang := strings.ToLower(os.Getenv("DEFAULT_ERROR_LANGUAGE")); lang != "" {
+		if _, ok := errorMessages[lang]; ok || lang == "en" {
+			defaultErrorLanguage = lang
+		} else {
+			log.Printf("Invalid DEFAULT_ERROR_LANGUAGE %q, using en", lang)
+		}
+	}
+	if streamChunkDelay > maxStreamChunkDelay {
+		log.Printf("STREAM_CHUNK_DELAY_MS exceeds %v, using the maximum", maxStreamChunkDelay)
+		streamChunkDelay = maxStreamChunkDelay
+	}
+	corsEnabled = envBool("CORS_ENABLED", true)
+	corsMaxAge = envInt("CORS_MAX_AGE_SECONDS", 86400)
+	hstsEnabled = envBool("HSTS_ENABLED", false)
+	exposeUpstreamRequestID = envBool("EXPOSE_UPSTREAM_REQUEST_ID", false)
+	featureFlags.Store(&FeatureFlags{
+		DeveloperRoleAsSystem: envBool("DEVELOPER_ROLE_AS_SYSTEM", true),
+		CreatedFromProxy:      envBool("CREATED_FROM_PROXY", false),
+		CostHeader:            envBool("COST_HEADER", false),
+		ValidateToolArguments: envBool("VALIDATE_TOOL_ARGUMENTS", false),
+		ContextFallback:       envBool("CONTEXT_FALLBACK", false),
+		StreamReconnect:       envBool("STREAM_RECONNECT", false),
+		StreamEmptyRetry:      envBool("STREAM_EMPTY_RETRY", false),
+		StreamUsageChunk:      envBool("STREAM_USAGE_CHUNK", false),
+		SSEEventIDs:           envBool("SSE_EVENT_IDS", false),
+		TransformTrace:        envBool("TRANSFORM_TRACE", false),
+		MergeMessages:         envBool("MERGE_MESSAGES", false),
+		SanitizeControlChars:  envBool("SANITIZE_CONTROL_CHARS", false),
+		LegacyFinishReason:    envBool("LEGACY_FINISH_REASON", true),
+		EmptyToolContent:      envBool("EMPTY_TOOL_CONTENT", true),
+	})
+	messageMergeSeparator = "\n\n"
+	if sep, ok := os.LookupEnv("MESSAGE_MERGE_SEPARATOR"); ok {
+		unquoted, err := strconv.Unquote(`"` + sep + `"`)
+		if err != nil {
+			log.Fatalf("Invalid MESSAGE_MERGE_SEPARATOR: %v", err)
+		}
+		messageMergeSeparator = unquoted
+	}
+
+	if defaults := os.Getenv("DEFAULT_SYSTEM_MESSAGES"); defaults != "" {
+		if err := json.Unmarshal([]byte(defaults), &defaultSystemMessages); err != nil {
+			log.Fatalf("Invalid DEFAULT_SYSTEM_MESSAGES (expected a JSON object of model to message): %v", err)
+		}
+	}
+
+	logPrompts = os.Getenv("LOG_PROMPTS")
+	switch logPrompts {
+	case "", "off":
+		logPrompts = "off"
+	case "full", "redacted":
+		target := os.Getenv("PROMPT_LOG_SINK")
+		if target == "" {
+			log.Fatal("PROMPT_LOG_SINK is required when LOG_PROMPTS is enabled")
 		}
-		activeConfig = Config{
-			endpoint: openRouterEndpoint,
-			model:    deepseekOpenRouterModel,
-			apiKey:   openRouterAPIKey,
+		sink, err := newPromptSink(target)
+		if err != nil {
+			log.Fatalf("Error opening prompt log sink: %v", err)
+		}
+		promptSink = sink
+		promptSampleRate = 1
+		if rate := os.Getenv("PROMPT_LOG_SAMPLE_RATE"); rate != "" {
+			v, err := strconv.ParseFloat(rate, 64)
+			if err != nil || v < 0 || v > 1 {
+				log.Fatalf("Invalid PROMPT_LOG_SAMPLE_RATE: %s", rate)
+			}
+			promptSampleRate = v
 		}
+		log.Printf("Logging %s prompts to %s with sample rate %.2f", logPrompts, target, promptSampleRate)
 	default:
-		log.Printf("Invalid model specified: %s. Using default chat model.", modelFlag)
-		if deepseekAPIKey == "" {
-			log.Fatal("DEEPSEEK_API_KEY is required for default chat model")
+		log.Fatalf("Invalid LOG_PROMPTS: %s (expected off, full or redacted)", logPrompts)
+	}
+	parseModelPricing(os.Getenv("MODEL_PRICING"))
+	parseModelLimits("STOP_SEQUENCE_LIMITS", os.Getenv("STOP_SEQUENCE_LIMITS"), stopSequenceLimits)
+	parseModelLimits("MAX_OUTPUT_TOKENS", os.Getenv("MAX_OUTPUT_TOKENS"), maxOutputTokens)
+	parseParamRanges("TEMPERATURE_RANGES", os.Getenv("TEMPERATURE_RANGES"), temperatureRanges)
+	parseParamRanges("TOP_P_RANGES", os.Getenv("TOP_P_RANGES"), topPRanges)
+
+	if spec := os.Getenv("EXPERIMENT_MODELS"); spec != "" {
+		variants, err := parseExperimentVariants(spec)
+		if err != nil {
+			log.Fatalf("Invalid EXPERIMENT_MODELS: %v", err)
 		}
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
-			apiKey:   deepseekAPIKey,
+		experimentVariants = variants
+		log.Printf("A/B experiment across %d model variants", len(variants))
+	}
+	slowRequestThreshold = time.Duration(envInt("SLOW_REQUEST_MS", 0)) * time.Millisecond
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		store, err := newRedisStore(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
 		}
+		redisBackend = store
+		log.Printf("Sharing caches and quotas through Redis at %s", store.addr)
+	}
+	if ttl := envInt("IDEMPOTENCY_TTL_SECONDS", 300); ttl > 0 {
+		idempotencyCache = newResponseCache(newStore(envInt("IDEMPOTENCY_MAX_ENTRIES", 10000)), "idempotency", time.Duration(ttl)*time.Second)
 	}
+	hedgeDelay = time.Duration(envInt("HEDGE_DELAY_MS", 0)) * time.Millisecond
+	streamUpgradeAfter = time.Duration(envInt("STREAM_UPGRADE_MS", 0)) * time.Millisecond
+	streamSetupRetries = envInt("STREAM_SETUP_RETRIES", 0)
+	streamSetupRetryDelay = time.Duration(envInt("STREAM_SETUP_RETRY_DELAY_MS", 500)) * time.Millisecond
+	retryJitter = envBool("RETRY_JITTER", false)
+	retryMaxElapsed = time.Duration(envInt("RETRY_MAX_ELAPSED_MS", 0)) * time.Millisecond
+	fakeUpstream = envBool("FAKE_UPSTREAM", false)
+	if fakeUpstream {
+		log.Printf("FAKE_UPSTREAM enabled: requests will not be forwarded upstream")
+	}
+	maxHeaderCount = envInt("MAX_HEADER_COUNT", 100)
+	maxHeaderBytes = envInt("MAX_HEADER_BYTES", 64*1024)
+	maxTools = envInt("MAX_TOOLS", 0)
+	logBodyMaxBytes = envInt("LOG_BODY_MAX_BYTES", 4096)
+	debugPretty = envBool("DEBUG_PRETTY", false)
+	defaultAcceptLanguage = os.Getenv("DEFAULT_ACCEPT_LANGUAGE")
+	adminToken = os.Getenv("ADMIN_TOKEN")
 
-	log.Printf("Initialized with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
+	if tokenQuota = envInt("TOKEN_QUOTA", 0); tokenQuota > 0 {
+		window := time.Duration(envInt("TOKEN_QUOTA_WINDOW_HOURS", 24)) * time.Hour
+		quotaStore = storeQuota{store: newStore(0), window: window}
+		log.Printf("Enforcing a quota of %d tokens per client key every %v", tokenQuota, window)
+	}
+	batchMaxSize = envInt("BATCH_MAX_SIZE", 20)
+	anthropicMessages = envBool("ANTHROPIC_MESSAGES", false)
+	batchConcurrency = envInt("BATCH_CONCURRENCY", 4)
+	if batchConcurrency < 1 {
+		batchConcurrency = 1
+	}
+	requireMaxTokens = envBool("REQUIRE_MAX_TOKENS", false)
+	parseFinishReasonMap(os.Getenv("FINISH_REASON_MAP"))
+
+	largeContextThreshold = envInt("LARGE_CONTEXT_THRESHOLD", 0)
+	largeContextModel = os.Getenv("LARGE_CONTEXT_MODEL")
+	largeContextProvider = os.Getenv("LARGE_CONTEXT_PROVIDER")
+	if largeContextProvider != "" {
+		if _, err := providerConfig(largeContextProvider); err != nil {
+			log.Fatalf("Invalid LARGE_CONTEXT_PROVIDER: %v", err)
+		}
+	}
+
+	if spec := os.Getenv("MODEL_ROUTING_RULES"); spec != "" {
+		rules, err := parseRoutingRules(spec)
+		if err != nil {
+			log.Fatalf("Invalid MODEL_ROUTING_RULES: %v", err)
+		}
+		routingRules = rules
+		log.Printf("Loaded %d model routing rules", len(rules))
+	}
+
+	toolsTarget = parseModelTarget("TOOLS_MODEL", os.Getenv("TOOLS_MODEL"))
+	noToolsTarget = parseModelTarget("NO_TOOLS_MODEL", os.Getenv("NO_TOOLS_MODEL"))
+
+	emptyChoicesMode = os.Getenv("EMPTY_CHOICES_MODE")
+	switch emptyChoicesMode {
+	case "":
+		emptyChoicesMode = "content_filter"
+	case "content_filter", "error":
+	default:
+		log.Printf("Invalid EMPTY_CHOICES_MODE: %s. Using content_filter.", emptyChoicesMode)
+		emptyChoicesMode = "content_filter"
+	}
+
+	requestWebhookURL = os.Getenv("REQUEST_WEBHOOK_URL")
+	requestWebhookTimeout = time.Duration(envInt("REQUEST_WEBHOOK_TIMEOUT_MS", 2000)) * time.Millisecond
+	requestWebhookFailMode = os.Getenv("REQUEST_WEBHOOK_FAIL_MODE")
+	switch requestWebhookFailMode {
+	case "":
+		requestWebhookFailMode = "closed"
+	case "open", "closed":
+	default:
+		log.Printf("Invalid REQUEST_WEBHOOK_FAIL_MODE: %s. Using closed.", requestWebhookFailMode)
+		requestWebhookFailMode = "closed"
+	}
+
+	jsonModeValidation = os.Getenv("JSON_MODE_VALIDATION")
+	switch jsonModeValidation {
+	case "":
+		jsonModeValidation = "off"
+	case "off", "annotate", "retry":
+	default:
+		log.Printf("Invalid JSON_MODE_VALIDATION: %s. Using off.", jsonModeValidation)
+		jsonModeValidation = "off"
+	}
+
+	duplicateToolCallIDs = os.Getenv("DUPLICATE_TOOL_CALL_IDS")
+	switch duplicateToolCallIDs {
+	case "":
+		duplicateToolCallIDs = "rename"
+	case "rename", "dedupe", "keep":
+	default:
+		log.Printf("Invalid DUPLICATE_TOOL_CALL_IDS: %s. Using rename.", duplicateToolCallIDs)
+		duplicateToolCallIDs = "rename"
+	}
+}
+
+// FeatureFlags switches the optional request and response transforms. They are loaded from
+// the environment at startup and can be changed at runtime through /admin/flags.
+type FeatureFlags struct {
+	DeveloperRoleAsSystem bool `json:"developer_role_as_system"`
+	CreatedFromProxy      bool `json:"created_from_proxy"`
+	CostHeader            bool `json:"cost_header"`
+	ValidateToolArguments bool `json:"validate_tool_arguments"`
+	ContextFallback       bool `json:"context_fallback"`
+	StreamReconnect       bool `json:"stream_reconnect"`
+	StreamEmptyRetry      bool `json:"stream_empty_retry"`
+	StreamUsageChunk      bool `json:"stream_usage_chunk"`
+	SSEEventIDs           bool `json:"sse_event_ids"`
+	TransformTrace        bool `json:"transform_trace"`
+	MergeMessages         bool `json:"merge_messages"`
+	SanitizeControlChars  bool `json:"sanitize_control_chars"`
+	LegacyFinishReason    bool `json:"legacy_finish_reason"`
+	EmptyToolContent      bool `json:"empty_tool_content"`
+}
+
+var featureFlags atomic.Pointer[FeatureFlags]
+
+// flags returns the current feature flags
+func flags() *FeatureFlags {
+	return featureFlags.Load()
+}
+
+// envBool reads a boolean environment variable, falling back to def when unset or invalid
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %v", name, value, def)
+		return def
+	}
+	return b
+}
+
+// envInt reads an integer environment variable, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// probeUpstream performs a single authenticated request to the upstream /models endpoint
+func probeUpstream(cfg Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), modelsTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.endpoint+"/models", nil)
+	if err != nil {
+		return fmt.Errorf("error creating probe request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error connecting to upstream: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// keepUpstreamWarm opens the upstream HTTP/2 connection right away and refreshes it every
+// interval until ctx is done, so the first client request does not pay for the TLS handshake
+func keepUpstreamWarm(ctx context.Context, cfg Config, interval time.Duration) {
+	for {
+		if err := probeUpstream(cfg); err != nil {
+			log.Printf("Upstream warm-up failed: %v", err)
+		} else {
+			debugLog("Upstream connection to %s warmed up", cfg.endpoint)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
 }
 
 // Models response structure
@@ -182,6 +1370,57 @@ type ChatRequest struct {
 	ToolChoice  interface{} `json:"tool_choice,omitempty"`
 	Temperature *float64    `json:"temperature,omitempty"`
 	MaxTokens   *int        `json:"max_tokens,omitempty"`
+
+	// Fields not modeled above, passed through to the upstream as-is
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON decodes the modeled fields and keeps the remaining ones in Extra
+func (c *ChatRequest) UnmarshalJSON(data []byte) error {
+	type plain ChatRequest
+	var wire struct {
+		plain
+		Stream flexBool `json:"stream"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	req := wire.plain
+	req.Stream = bool(wire.Stream)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if supportedFields[name] || droppedFields[name] {
+			continue
+		}
+		if req.Extra == nil {
+			req.Extra = make(map[string]json.RawMessage)
+		}
+		req.Extra[name] = value
+	}
+
+	*c = ChatRequest(req)
+	return nil
+}
+
+// flexBool accepts booleans sent as JSON booleans, strings ("true", "0"), numbers or null
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "null" || value == "" {
+		*b = false
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean value %s", data)
+	}
+	*b = flexBool(parsed)
+	return nil
 }
 
 type Message struct {
@@ -190,6 +1429,62 @@ type Message struct {
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string     `json:"tool_call_id,omitempty"`
 	Name       string     `json:"name,omitempty"`
+
+	// Chain of thought returned by deepseek-reasoner; never sent back upstream
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+
+	// Set when a tool result arrived as structured JSON and Content holds its serialization
+	structuredContent bool
+
+	// Set on tool-call-only replies whose empty content is sent to the client as null
+	nullContent bool
+}
+
+// MarshalJSON writes "content": null for messages marked nullContent
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if !m.nullContent {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content *string `json:"content"`
+	}{plain: plain(m)})
+}
+
+// UnmarshalJSON accepts null content, and tool or function results whose content is
+// structured JSON rather than a string; that JSON is kept, compacted, as the content text
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var wire struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	msg := wire.plain
+
+	content := bytes.TrimSpace(wire.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+	case content[0] == '"':
+		if err := json.Unmarshal(content, &msg.Content); err != nil {
+			return err
+		}
+	case msg.Role == "tool" || msg.Role == "function":
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, content); err != nil {
+			return err
+		}
+		msg.Content = compact.String()
+		msg.structuredContent = true
+	default:
+		return fmt.Errorf("content of %s message must be a string", msg.Role)
+	}
+
+	*m = Message(msg)
+	return nil
 }
 
 type Function struct {
@@ -212,15 +1507,84 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
+// supportedFields lists the request fields modeled by ChatRequest
+var supportedFields = map[string]bool{
+	"model":       true,
+	"messages":    true,
+	"stream":      true,
+	"functions":   true,
+	"tools":       true,
+	"tool_choice": true,
+	"temperature": true,
+	"max_tokens":  true,
+}
+
+// droppedFields lists OpenAI request fields DeepSeek does not accept; they are not forwarded
+var droppedFields = map[string]bool{
+	"logit_bias":    true,
+	"n":             true,
+	"service_tier":  true,
+	"store":         true,
+	"metadata":      true,
+	"function_call": true,
+}
+
+// unsupportedFields returns the sorted top-level request fields that are not forwarded upstream
+func unsupportedFields(body []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+
+	var dropped []string
+	for name := range fields {
+		if droppedFields[name] {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// unchangedByConversion reports whether the original body already is the converted request
+func unchangedByConversion(body []byte, converted DeepSeekRequest) bool {
+	if len(unsupportedFields(body)) > 0 {
+		return false
+	}
+
+	var original DeepSeekRequest
+	if err := json.Unmarshal(body, &original); err != nil {
+		return false
+	}
+	// Structured tool results must be sent as strings
+	for _, msg := range original.Messages {
+		if msg.structuredContent {
+			return false
+		}
+	}
+	// Passed-through fields are carried over verbatim unless trimmed on the way
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return false
+	}
+	for key, value := range converted.Extra {
+		if !bytes.Equal(raw[key], value) {
+			return false
+		}
+	}
+	converted.Extra = nil
+	return reflect.DeepEqual(original, converted)
+}
+
 func convertToolChoice(choice interface{}) string {
 	if choice == nil {
 		return ""
 	}
 
-	// If string "auto" or "none"
+	// If string "auto", "none" or "required" (DeepSeek accepts all three)
 	if str, ok := choice.(string); ok {
 		switch str {
-		case "auto", "none":
+		case "auto", "none", "required":
 			return str
 		}
 	}
@@ -235,12 +1599,20 @@ func convertToolChoice(choice interface{}) string {
 	return ""
 }
 
-func convertMessages(messages []Message) []Message {
+func convertMessages(messages []Message, model string) []Message {
 	converted := make([]Message, len(messages))
 	for i, msg := range messages {
 		log.Printf("Converting message %d - Role: %s", i, msg.Role)
 		converted[i] = msg
 
+		// deepseek-reasoner rejects its own reasoning output in the conversation history
+		converted[i].ReasoningContent = ""
+
+		// Stray control characters make the upstream reject the request
+		if flags().SanitizeControlChars {
+			converted[i].Content = stripControlChars(msg.Content)
+		}
+
 		// Handle assistant messages with tool calls
 		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
 			log.Printf("Processing assistant message with %d tool calls", len(msg.ToolCalls))
@@ -257,6 +1629,12 @@ func convertMessages(messages []Message) []Message {
 			converted[i].ToolCalls = toolCalls
 		}
 
+		// DeepSeek does not know OpenAI's developer role, which plays the system role
+		if msg.Role == "developer" && flags().DeveloperRoleAsSystem {
+			log.Printf("Converting developer message to system message")
+			converted[i].Role = "system"
+		}
+
 		// Handle function response messages
 		if msg.Role == "function" {
 			log.Printf("Converting function response to tool response")
@@ -265,6 +1643,16 @@ func convertMessages(messages []Message) []Message {
 		}
 	}
 
+	if flags().MergeMessages {
+		converted = mergeConsecutiveMessages(converted)
+	}
+
+	// Start with the model's default system message unless the client sent one
+	if system, ok := defaultSystemMessages[model]; ok && !hasSystemMessage(messages) {
+		log.Printf("Injecting default system message for model %s", model)
+		converted = append([]Message{{Role: "system", Content: system}}, converted...)
+	}
+
 	// Log the final converted messages
 	for i, msg := range converted {
 		log.Printf("Final message %d - Role: %s, Content: %s", i, msg.Role, truncateString(msg.Content, 50))
@@ -276,159 +1664,417 @@ func convertMessages(messages []Message) []Message {
 	return converted
 }
 
-func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
-	}
-	return s[:maxLen] + "..."
+// stripControlChars removes control characters other than tab, newline and carriage return
+func stripControlChars(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, s)
 }
 
-// DeepSeek request structure
-type DeepSeekRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
+// mergeConsecutiveMessages joins runs of plain messages with the same role, which DeepSeek may
+// reject, into one message. Tool results and messages carrying tool calls are never merged.
+func mergeConsecutiveMessages(messages []Message) []Message {
+	merged := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if prev.Role == msg.Role && prev.Role != "tool" && prev.Name == msg.Name &&
+				len(prev.ToolCalls) == 0 && len(msg.ToolCalls) == 0 {
+				log.Printf("Merging consecutive %s messages", msg.Role)
+				switch {
+				case prev.Content == "":
+					prev.Content = msg.Content
+				case msg.Content != "":
+					prev.Content += messageMergeSeparator + msg.Content
+				}
+				continue
+			}
+		}
+		merged = append(merged, msg)
+	}
+	return merged
 }
 
-func debugLog(format string, args ...interface{}) {
-	if debugMode {
-		log.Printf(format, args...)
+// validateMessages requires a user or system message with content and a non-empty final user message
+func validateMessages(messages []Message) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("messages must contain at least one message")
+	}
+	if last := messages[len(messages)-1]; last.Role == "user" && strings.TrimSpace(last.Content) == "" {
+		return fmt.Errorf("the final user message (messages[%d]) has empty content", len(messages)-1)
 	}
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user", "system", "developer":
+			if strings.TrimSpace(msg.Content) != "" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("messages must include at least one user or system message with non-empty content")
 }
 
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-
-	server := &http.Server{
-		Addr:    ":9000",
-		Handler: http.HandlerFunc(proxyHandler),
+// hasSystemMessage reports whether the conversation already carries a system message
+func hasSystemMessage(messages []Message) bool {
+	for _, msg := range messages {
+		if msg.Role == "system" || (msg.Role == "developer" && flags().DeveloperRoleAsSystem) {
+			return true
+		}
 	}
+	return false
+}
 
-	// Enable HTTP/2 support
-	http2.ConfigureServer(server, &http2.Server{})
-
-	log.Printf("Starting proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+// estimateTokens roughly approximates the prompt token count (about four characters per token)
+func estimateTokens(messages []Message) int {
+	chars := 0
+	for _, msg := range messages {
+		chars += len(msg.Role) + len(msg.Content) + len(msg.Name)
+		for _, tc := range msg.ToolCalls {
+			chars += len(tc.Function.Name) + len(tc.Function.Arguments)
+		}
 	}
+	return chars/4 + 1
 }
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+// Summarizer condenses the older part of a conversation into a short text
+type Summarizer interface {
+	Summarize(ctx context.Context, cfg Config, messages []Message) (string, error)
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	debugLog("Received request: %s %s", r.Method, r.URL.Path)
-
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
-	}
+// summarizer compacts conversations above CONVERSATION_TOKEN_BUDGET
+var summarizer Summarizer = upstreamSummarizer{}
 
-	enableCors(w)
+// upstreamSummarizer asks the request's own upstream model for the summary
+type upstreamSummarizer struct{}
 
-	// Validate API key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		debugLog("Missing or invalid Authorization header")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-		return
+func (upstreamSummarizer) Summarize(ctx context.Context, cfg Config, messages []Message) (string, error) {
+	if completionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, completionTimeout)
+		defer cancel()
 	}
-
-	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if userAPIKey != activeConfig.apiKey {
-		log.Printf("Invalid API key provided")
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
-		return
+	if blockedModels[cfg.model] {
+		return "", fmt.Errorf("summary model %s is blocked", cfg.model)
 	}
-
-	// Handle /v1/models endpoint
-	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		log.Printf("Handling /v1/models request")
-		handleModelsRequest(w)
-		return
+	var transcript strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+		for _, tc := range msg.ToolCalls {
+			fmt.Fprintf(&transcript, "%s called %s(%s)\n", msg.Role, tc.Function.Name, tc.Function.Arguments)
+		}
 	}
-
-	// Log headers for debugging
-	debugLog("Request headers: %+v", r.Header)
-
-	// Read and log request body for debugging
-	var chatReq ChatRequest
-	body, err := io.ReadAll(r.Body)
+	body, err := json.Marshal(DeepSeekRequest{
+		Model: cfg.model,
+		Messages: []Message{
+			{Role: "system", Content: "Summarize the following conversation in a few sentences. Keep facts, decisions, names and open questions; leave out pleasantries."},
+			{Role: "user", Content: transcript.String()},
+		},
+	})
 	if err != nil {
-		debugLog("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
-		return
+		return "", err
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		log.Printf("Raw request body: %s", string(body))
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL(cfg, "/v1/chat/completions", ""), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sendUpstream(cfg.name, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("summary request returned status %d", resp.StatusCode)
 	}
 
-	log.Printf("Parsed request: %+v", chatReq)
+	var completion struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", err
+	}
+	// Charge the summary to the client request's quota
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.summaryTokens += completion.Usage.TotalTokens
+	}
+	if len(completion.Choices) == 0 || strings.TrimSpace(completion.Choices[0].Message.Content) == "" {
+		return "", errors.New("summary request returned no content")
+	}
+	return strings.TrimSpace(completion.Choices[0].Message.Content), nil
+}
 
-	// Handle models endpoint
-	if r.URL.Path == "/v1/models" {
-		handleModelsRequest(w)
-		return
+// compactConversation replaces the oldest messages of a conversation above the token budget
+// with one system message summarizing them. Leading system messages and the newest messages,
+// up to half the budget, are kept as they are; a tool result stays with the call before it.
+func compactConversation(ctx context.Context, cfg Config, messages []Message, budget int) ([]Message, error) {
+	if estimateTokens(messages) <= budget {
+		return messages, nil
 	}
 
-	// Only handle API requests with /v1/ prefix
-	if !strings.HasPrefix(r.URL.Path, "/v1/") {
-		log.Printf("Invalid path: %s", r.URL.Path)
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
+	start := 0
+	for start < len(messages) && messages[start].Role == "system" {
+		start++
+	}
+	keep := len(messages) - 1
+	for keep > start && estimateTokens(messages[keep-1:]) <= budget/2 {
+		keep--
+	}
+	for keep > start && messages[keep].Role == "tool" {
+		keep--
+	}
+	if keep <= start {
+		return messages, nil
 	}
 
-	// Restore the body for further reading
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
+	summary, err := summarizer.Summarize(ctx, cfg, messages[start:keep])
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Summarized %d older messages to fit the conversation budget of %d tokens", keep-start, budget)
 
-	log.Printf("Request body: %s", string(body))
+	compacted := make([]Message, 0, start+1+len(messages)-keep)
+	compacted = append(compacted, messages[:start]...)
+	compacted = append(compacted, Message{Role: "system", Content: "Summary of the earlier conversation: " + summary})
+	return append(compacted, messages[keep:]...), nil
+}
 
-	// Parse the request to check for streaming - reuse existing chatReq
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		http.Error(w, "Error parsing request", http.StatusBadRequest)
-		return
+// largeContextConfig returns the configuration used for prompts above LARGE_CONTEXT_THRESHOLD
+func largeContextConfig(cfg Config) Config {
+	if largeContextProvider != "" {
+		providerCfg, err := providerConfig(largeContextProvider)
+		if err != nil {
+			log.Printf("Error using large-context provider: %v", err)
+		} else {
+			cfg = providerCfg
+		}
 	}
+	if largeContextModel != "" {
+		cfg.model = largeContextModel
+	}
+	return cfg
+}
 
-	log.Printf("Requested model: %s", chatReq.Model)
+// routingRule sends prompts with an estimated token count in [min, max] to a model,
+// optionally on another provider; max < 0 means no upper bound
+type routingRule struct {
+	min, max int
+	model    string
+	provider string
+}
 
-	// Replace gpt-4o model with the appropriate deepseek model
-	if chatReq.Model == gpt4oModel {
-		log.Printf("Converting gpt-4o to configured model: %s (endpoint: %s)", activeConfig.model, activeConfig.endpoint)
-		chatReq.Model = activeConfig.model
-		log.Printf("Model converted to: %s", activeConfig.model)
-	} else {
-		log.Printf("Unsupported model requested: %s", chatReq.Model)
-		http.Error(w, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, gpt4oModel), http.StatusBadRequest)
-		return
+// parseRoutingRules parses "min-max=model[@provider]" entries separated by commas, e.g.
+// "0-2000=deepseek-chat,2001-=deepseek-reasoner@reasoner"; an empty max is unbounded
+func parseRoutingRules(spec string) ([]routingRule, error) {
+	var rules []routingRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tokenRange, target, ok := strings.Cut(entry, "=")
+		from, to, isRange := strings.Cut(tokenRange, "-")
+		if !ok || !isRange || target == "" {
+			return nil, fmt.Errorf("invalid rule %q (expected min-max=model[@provider])", entry)
+		}
+
+		rule := routingRule{max: -1}
+		var err error
+		if rule.min, err = strconv.Atoi(strings.TrimSpace(from)); err != nil || rule.min < 0 {
+			return nil, fmt.Errorf("invalid minimum in rule %q", entry)
+		}
+		if to = strings.TrimSpace(to); to != "" {
+			if rule.max, err = strconv.Atoi(to); err != nil || rule.max < rule.min {
+				return nil, fmt.Errorf("invalid maximum in rule %q", entry)
+			}
+		}
+		rule.model, rule.provider, _ = strings.Cut(strings.TrimSpace(target), "@")
+		if rule.provider != "" {
+			if _, err := providerConfig(rule.provider); err != nil {
+				return nil, fmt.Errorf("rule %q: %w", entry, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// routeByTokens applies the first routing rule matching the estimated prompt tokens
+func routeByTokens(cfg Config, tokens int) (Config, bool) {
+	for _, rule := range routingRules {
+		if tokens < rule.min || (rule.max >= 0 && tokens > rule.max) {
+			continue
+		}
+		if rule.provider != "" {
+			providerCfg, err := providerConfig(rule.provider)
+			if err != nil {
+				log.Printf("Error using routing rule provider: %v", err)
+				return cfg, false
+			}
+			cfg = providerCfg
+		}
+		cfg.model = rule.model
+		return cfg, true
+	}
+	return cfg, false
+}
+
+// modelTarget is a model, optionally on another provider, written as "model[@provider]"
+type modelTarget struct {
+	model    string
+	provider string
+}
+
+// parseModelTarget parses a "model[@provider]" setting, exiting on an unknown provider
+func parseModelTarget(name, spec string) modelTarget {
+	var target modelTarget
+	target.model, target.provider, _ = strings.Cut(strings.TrimSpace(spec), "@")
+	if target.provider != "" {
+		if _, err := providerConfig(target.provider); err != nil {
+			log.Fatalf("Invalid %s: %v", name, err)
+		}
+	}
+	return target
+}
+
+// usesTools reports whether the model may call a tool for this request
+func usesTools(chatReq ChatRequest) bool {
+	if convertToolChoice(chatReq.ToolChoice) == "none" {
+		return false
+	}
+	return len(chatReq.Tools) > 0 || len(chatReq.Functions) > 0
+}
+
+// routeByToolUse switches to TOOLS_MODEL or NO_TOOLS_MODEL depending on whether the request
+// offers the model any tools
+func routeByToolUse(cfg Config, chatReq ChatRequest) (Config, bool) {
+	target := noToolsTarget
+	if usesTools(chatReq) {
+		target = toolsTarget
+	}
+	if target.model == "" {
+		return cfg, false
+	}
+	if target.provider != "" {
+		providerCfg, err := providerConfig(target.provider)
+		if err != nil {
+			log.Printf("Error using tool routing provider: %v", err)
+			return cfg, false
+		}
+		cfg = providerCfg
+	}
+	cfg.model = target.model
+	return cfg, true
+}
+
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "..."
+}
+
+// logBody renders a request or response body for logging, truncated to LOG_BODY_MAX_BYTES
+func logBody(body []byte) string {
+	// Re-indent JSON bodies for readability in debug mode with DEBUG_PRETTY
+	if debugMode && debugPretty && json.Valid(body) {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			body = indented.Bytes()
+		}
+	}
+	if logBodyMaxBytes <= 0 || len(body) <= logBodyMaxBytes {
+		return string(body)
+	}
+	return fmt.Sprintf("%s (%d bytes total)", truncateString(string(body), logBodyMaxBytes), len(body))
+}
+
+// DeepSeek request structure
+type DeepSeekRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Tools       []Tool    `json:"tools,omitempty"`
+	ToolChoice  string    `json:"tool_choice,omitempty"`
+
+	// Client fields passed through unchanged
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON encodes the modeled fields and merges in the passed-through ones
+func (d DeepSeekRequest) MarshalJSON() ([]byte, error) {
+	type plain DeepSeekRequest
+	data, err := json.Marshal(plain(d))
+	if err != nil || len(d.Extra) == 0 {
+		return data, err
+	}
+
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+	for name, value := range d.Extra {
+		if _, ok := merged[name]; !ok {
+			merged[name] = value
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// requestHash returns a deterministic key over every generation-affecting field of a request.
+// The request is re-encoded through a generic value so that all object keys, including those
+// of passed-through fields, are serialized in sorted order.
+func requestHash(req DeepSeekRequest) string {
+	req.Stream = false // streaming does not change what is generated
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber() // keep large integers such as seeds exact
+	if err := decoder.Decode(&generic); err != nil {
+		return ""
+	}
+	canonical, err := json.Marshal(generic)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// buildDeepSeekRequest converts a parsed OpenAI request into the upstream request format
+func buildDeepSeekRequest(chatReq ChatRequest, cfg Config) (DeepSeekRequest, error) {
+	if requireMaxTokens && chatReq.MaxTokens == nil {
+		return DeepSeekRequest{}, fmt.Errorf("max_tokens is required by this proxy's configuration")
 	}
 
-	// Convert to DeepSeek request format
 	deepseekReq := DeepSeekRequest{
-		Model:    activeConfig.model, // Ensure we use the configured model
-		Messages: convertMessages(chatReq.Messages),
+		Model:    cfg.model, // Ensure we use the configured model
+		Messages: convertMessages(chatReq.Messages, cfg.model),
 		Stream:   chatReq.Stream,
+		Extra:    chatReq.Extra,
 	}
 
-	log.Printf("Creating DeepSeek request with model: %s at endpoint: %s", deepseekReq.Model, activeConfig.endpoint)
+	log.Printf("Creating DeepSeek request with model: %s at endpoint: %s", deepseekReq.Model, cfg.endpoint)
 
 	// Copy optional parameters if present
 	if chatReq.Temperature != nil {
-		deepseekReq.Temperature = *chatReq.Temperature
+		temperature := *chatReq.Temperature
+		deepseekReq.Temperature = &temperature
 	}
 	if chatReq.MaxTokens != nil {
 		deepseekReq.MaxTokens = *chatReq.MaxTokens
@@ -457,287 +2103,4324 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Create new request body
-	modifiedBody, err := json.Marshal(deepseekReq)
-	if err != nil {
-		log.Printf("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
-		return
+	if maxTools > 0 && len(deepseekReq.Tools) > maxTools {
+		return DeepSeekRequest{}, fmt.Errorf("request defines %d tools, which exceeds the maximum of %d", len(deepseekReq.Tools), maxTools)
 	}
 
-	log.Printf("Modified request body: %s", string(modifiedBody))
+	trimStopSequences(&deepseekReq)
+	clampSamplingParams(&deepseekReq)
+	clampMaxTokens(&deepseekReq)
 
-	// Create the proxy request to DeepSeek
-	targetURL := activeConfig.endpoint + r.URL.Path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
+	return deepseekReq, nil
+}
 
-	log.Printf("Using endpoint %s with model %s", activeConfig.endpoint, activeConfig.model)
-	log.Printf("Forwarding to: %s", targetURL)
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		log.Printf("Error creating proxy request: %v", err)
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
-		return
+// stopSequenceLimits caps the number of stop sequences per model ("*" applies to any other model),
+// extended through STOP_SEQUENCE_LIMITS
+var stopSequenceLimits = map[string]int{
+	"deepseek-chat":     16,
+	"deepseek-coder":    16,
+	"deepseek-reasoner": 16,
+}
+
+// maxOutputTokens caps max_tokens at each model's output limit ("*" applies to any other model),
+// extended through MAX_OUTPUT_TOKENS
+var maxOutputTokens = map[string]int{
+	"deepseek-chat":     8192,
+	"deepseek-coder":    8192,
+	"deepseek-reasoner": 65536,
+}
+
+// paramRange is the valid range of a sampling parameter
+type paramRange struct {
+	min, max float64
+}
+
+// temperatureRanges and topPRanges bound the sampling parameters per model ("*" applies to any
+// other model), extended through TEMPERATURE_RANGES and TOP_P_RANGES
+var (
+	temperatureRanges = map[string]paramRange{
+		"deepseek-chat":          {0, 2},
+		"deepseek-coder":         {0, 2},
+		"deepseek/deepseek-chat": {0, 2},
+	}
+	topPRanges = map[string]paramRange{
+		"*": {0, 1},
 	}
+)
 
-	// Copy headers
-	copyHeaders(proxyReq.Header, r.Header)
+// experimentVariant is one model of the EXPERIMENT_MODELS A/B test with its traffic weight
+type experimentVariant struct {
+	model  string
+	weight int
+}
 
-	// Set DeepSeek API key and content type
-	proxyReq.Header.Set("Authorization", "Bearer "+activeConfig.apiKey)
-	proxyReq.Header.Set("Content-Type", "application/json")
+// parseExperimentVariants parses "model=weight" entries separated by commas
+func parseExperimentVariants(spec string) ([]experimentVariant, error) {
+	var variants []experimentVariant
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(model) == "" || err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid entry %q (expected model=weight)", entry)
+		}
+		variants = append(variants, experimentVariant{model: strings.TrimSpace(model), weight: weight})
+	}
+	return variants, nil
+}
 
-	// Add OpenRouter-specific headers if using OpenRouter
-	if activeConfig.endpoint == openRouterEndpoint {
-		proxyReq.Header.Set("HTTP-Referer", "https://github.com/danilofalcao/cursor-deepseek")
-		proxyReq.Header.Set("X-Title", "Cursor DeepSeek")
+// pickExperimentVariant deterministically maps a client to a variant in proportion to the weights
+func pickExperimentVariant(key string) string {
+	total := 0
+	for _, v := range experimentVariants {
+		total += v.weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, v := range experimentVariants {
+		if bucket < v.weight {
+			return v.model
+		}
+		bucket -= v.weight
 	}
+	return experimentVariants[len(experimentVariants)-1].model
+}
 
-	if chatReq.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
+// parseModelLimits parses "model=n" entries separated by commas into limits
+func parseModelLimits(name, spec string, limits map[string]int) {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || model == "" || err != nil || n < 1 {
+			log.Printf("Ignoring invalid %s entry: %q", name, entry)
+			continue
+		}
+		limits[strings.TrimSpace(model)] = n
 	}
+}
 
-	// Add Accept-Language header from request
-	if acceptLanguage := r.Header.Get("Accept-Language"); acceptLanguage != "" {
-		proxyReq.Header.Set("Accept-Language", acceptLanguage)
+// parseParamRanges parses "model=min-max" entries separated by commas into ranges
+func parseParamRanges(name, spec string, ranges map[string]paramRange) {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, value, ok := strings.Cut(entry, "=")
+		low, high, ok2 := strings.Cut(strings.TrimSpace(value), "-")
+		lo, err1 := strconv.ParseFloat(low, 64)
+		hi, err2 := strconv.ParseFloat(high, 64)
+		if !ok || !ok2 || strings.TrimSpace(model) == "" || err1 != nil || err2 != nil || lo > hi {
+			log.Printf("Ignoring invalid %s entry: %q", name, entry)
+			continue
+		}
+		ranges[strings.TrimSpace(model)] = paramRange{lo, hi}
 	}
+}
 
-	log.Printf("Proxy request headers: %v", proxyReq.Header)
+// rangeFor returns the model's range for a parameter, falling back to the "*" entry
+func rangeFor(ranges map[string]paramRange, model string) (paramRange, bool) {
+	if r, ok := ranges[model]; ok {
+		return r, true
+	}
+	r, ok := ranges["*"]
+	return r, ok
+}
 
-	// Use the global client instead of creating a new one
-	resp, err := httpClient.Do(proxyReq)
+func (r paramRange) clamp(v float64) float64 {
+	return math.Min(math.Max(v, r.min), r.max)
+}
+
+// clampSamplingParams moves temperature and top_p into the model's valid range
+func clampSamplingParams(req *DeepSeekRequest) {
+	if r, ok := rangeFor(temperatureRanges, req.Model); ok && req.Temperature != nil {
+		if clamped := r.clamp(*req.Temperature); clamped != *req.Temperature {
+			log.Printf("Warning: clamping temperature %g to %g for model %s", *req.Temperature, clamped, req.Model)
+			req.Temperature = &clamped
+		}
+	}
+
+	raw, ok := req.Extra["top_p"]
+	if !ok {
+		return
+	}
+	var topP float64
+	r, hasRange := rangeFor(topPRanges, req.Model)
+	if !hasRange || json.Unmarshal(raw, &topP) != nil || r.clamp(topP) == topP {
+		return
+	}
+	clamped, err := json.Marshal(r.clamp(topP))
 	if err != nil {
-		log.Printf("Error forwarding request: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
 
-	log.Printf("DeepSeek response status: %d", resp.StatusCode)
-	log.Printf("DeepSeek response headers: %v", resp.Header)
+	log.Printf("Warning: clamping top_p %g to %s for model %s", topP, clamped, req.Model)
+	extra := make(map[string]json.RawMessage, len(req.Extra))
+	for key, value := range req.Extra {
+		extra[key] = value
+	}
+	extra["top_p"] = clamped
+	req.Extra = extra
+}
 
-	// Handle error responses
-	if resp.StatusCode >= 400 {
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error reading error response: %v", err)
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
+// clampMaxTokens lowers max_tokens to the model's output limit, which DeepSeek would reject
+func clampMaxTokens(req *DeepSeekRequest) {
+	limit, ok := maxOutputTokens[req.Model]
+	if !ok {
+		if limit, ok = maxOutputTokens["*"]; !ok {
 			return
 		}
-		log.Printf("DeepSeek error response: %s", string(respBody))
+	}
+	if req.MaxTokens > limit {
+		log.Printf("Warning: clamping max_tokens %d to %d for model %s", req.MaxTokens, limit, req.Model)
+		req.MaxTokens = limit
+	}
+}
 
-		// Forward the error response
-		for k, v := range resp.Header {
-			w.Header()[k] = v
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
+// trimStopSequences drops stop sequences beyond the model's supported maximum
+func trimStopSequences(req *DeepSeekRequest) {
+	raw, ok := req.Extra["stop"]
+	if !ok {
 		return
 	}
+	limit, ok := stopSequenceLimits[req.Model]
+	if !ok {
+		if limit, ok = stopSequenceLimits["*"]; !ok {
+			return
+		}
+	}
 
-	// Handle streaming response
-	if chatReq.Stream {
-		handleStreamingResponse(w, r, resp)
+	// A single string stop sequence is always within the limit
+	var stops []string
+	if err := json.Unmarshal(raw, &stops); err != nil || len(stops) <= limit {
+		return
+	}
+	trimmed, err := json.Marshal(stops[:limit])
+	if err != nil {
 		return
 	}
 
-	// Handle regular response
-	handleRegularResponse(w, resp)
+	log.Printf("Warning: trimming %d stop sequences to the maximum of %d for model %s", len(stops), limit, req.Model)
+	extra := make(map[string]json.RawMessage, len(req.Extra))
+	for key, value := range req.Extra {
+		extra[key] = value
+	}
+	extra["stop"] = trimmed
+	req.Extra = extra
 }
 
-func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
-	debugLog("Starting streaming response handling")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
+// Token usage reported by the upstream, including DeepSeek's context caching counters
+type Usage struct {
+	PromptTokens          int                  `json:"prompt_tokens"`
+	CompletionTokens      int                  `json:"completion_tokens"`
+	TotalTokens           int                  `json:"total_tokens"`
+	PromptCacheHitTokens  int                  `json:"prompt_cache_hit_tokens,omitempty"`
+	PromptCacheMissTokens int                  `json:"prompt_cache_miss_tokens,omitempty"`
+	PromptTokensDetails   *PromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
 
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
+// OpenAI's representation of cached prompt tokens
+type PromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
 
-	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
+// Per-model prices in USD per million tokens
+type ModelPrice struct {
+	Input       float64 // prompt tokens (cache misses)
+	Output      float64 // completion tokens
+	CachedInput float64 // prompt tokens served from the context cache
+}
 
-	// Create a context with cancel for cleanup
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+// modelPricing holds the default price table, extended through MODEL_PRICING
+// (e.g. "deepseek-chat=0.27:1.10:0.07")
+var modelPricing = map[string]ModelPrice{
+	deepseekChatModel:       {Input: 0.27, Output: 1.10, CachedInput: 0.07},
+	deepseekCoderModel:      {Input: 0.27, Output: 1.10, CachedInput: 0.07},
+	deepseekOpenRouterModel: {Input: 0.27, Output: 1.10, CachedInput: 0.27},
+	deepseekReasonerModel:   {Input: 0.55, Output: 2.19, CachedInput: 0.14},
+}
+
+// parseModelPricing parses "model=input:output[:cached]" entries separated by commas into modelPricing
+func parseModelPricing(spec string) {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, prices, ok := strings.Cut(entry, "=")
+		parts := strings.Split(prices, ":")
+		if !ok || model == "" || len(parts) < 2 || len(parts) > 3 {
+			log.Printf("Ignoring invalid MODEL_PRICING entry: %q", entry)
+			continue
+		}
+
+		values := make([]float64, len(parts))
+		valid := true
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil || v < 0 {
+				valid = false
+				break
+			}
+			values[i] = v
+		}
+		if !valid {
+			log.Printf("Ignoring invalid MODEL_PRICING entry: %q", entry)
+			continue
+		}
+
+		price := ModelPrice{Input: values[0], Output: values[1], CachedInput: values[0]}
+		if len(values) == 3 {
+			price.CachedInput = values[2]
+		}
+		modelPricing[model] = price
+	}
+}
+
+// estimateCost derives the USD cost of a completion from its token usage
+func estimateCost(model string, usage Usage) (float64, bool) {
+	price, ok := modelPricing[model]
+	if !ok {
+		return 0, false
+	}
+
+	cached := usage.PromptCacheHitTokens
+	if cached > usage.PromptTokens {
+		cached = usage.PromptTokens
+	}
+	uncached := usage.PromptTokens - cached
+
+	cost := float64(uncached)*price.Input +
+		float64(cached)*price.CachedInput +
+		float64(usage.CompletionTokens)*price.Output
+	return cost / 1e6, true
+}
+
+func debugLog(format string, args ...interface{}) {
+	if debugMode {
+		log.Printf(format, args...)
+	}
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	// Replay a captured request offline instead of starting the server
+	if replayFile != "" {
+		if err := replayRequest(replayFile, os.Stdout); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
+	server := &http.Server{
+		Addr:    ":9000",
+		Handler: recoverPanics(proxyHandler),
+	}
+
+	// Enable HTTP/2 support
+	http2.ConfigureServer(server, &http2.Server{})
+
+	// Optionally verify the upstream is reachable before accepting traffic; in FAKE_UPSTREAM
+	// mode nothing is forwarded, so there is nothing to probe
+	if startupProbe && !fakeUpstream {
+		if err := probeUpstream(activeConfig); err != nil {
+			log.Fatalf("Startup probe failed: %v", err)
+		}
+		log.Printf("Startup probe succeeded for endpoint: %s", activeConfig.endpoint)
+	}
+
+	if warmupInterval > 0 && !fakeUpstream {
+		go keepUpstreamWarm(context.Background(), activeConfig, warmupInterval)
+	}
+
+	log.Printf("Starting proxy server %s on %s", version, server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// OpenAI compatible error envelope
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// errorMessages translates fixed proxy error messages, keyed by language and English text
+var errorMessages = map[string]map[string]string{
+	"de": {
+		"Request policy webhook is unavailable.":                                                                                        "Der Webhook für Anfragerichtlinien ist nicht erreichbar.",
+		"Token quota exceeded for this API key. Try again after the quota window resets.":                                               "Das Token-Kontingent für diesen API-Schlüssel ist erschöpft. Versuchen Sie es nach Ablauf des Kontingentzeitraums erneut.",
+		"Idempotency-Key was already used with a different request":                                                                     "Der Idempotency-Key wurde bereits für eine andere Anfrage verwendet",
+		"The upstream provider rejected the proxy's API key. This is a proxy configuration problem, not an issue with your client key.": "Der Upstream-Anbieter hat den API-Schlüssel des Proxys abgelehnt. Dies ist ein Konfigurationsproblem des Proxys, kein Problem mit Ihrem Client-Schlüssel.",
+		"Batch request must be a JSON array of chat completion requests":                                                                "Eine Batch-Anfrage muss ein JSON-Array von Chat-Completion-Anfragen sein",
+		"Invalid admin token":                             "Ungültiges Admin-Token",
+		"Use POST to flush caches":                        "Verwenden Sie POST, um Caches zu leeren",
+		"Use GET to view or POST to update feature flags": "Verwenden Sie GET zum Anzeigen oder POST zum Ändern der Feature-Flags",
+		"Internal proxy error":                            "Interner Proxy-Fehler",
+	},
+	"fr": {
+		"Request policy webhook is unavailable.":                                                                                        "Le webhook de politique des requêtes est indisponible.",
+		"Token quota exceeded for this API key. Try again after the quota window resets.":                                               "Quota de jetons dépassé pour cette clé d'API. Réessayez après la réinitialisation de la période de quota.",
+		"Idempotency-Key was already used with a different request":                                                                     "Cette Idempotency-Key a déjà été utilisée avec une autre requête",
+		"The upstream provider rejected the proxy's API key. This is a proxy configuration problem, not an issue with your client key.": "Le fournisseur amont a refusé la clé d'API du proxy. Il s'agit d'un problème de configuration du proxy, pas de votre clé client.",
+		"Batch request must be a JSON array of chat completion requests":                                                                "Une requête batch doit être un tableau JSON de requêtes de chat completion",
+		"Invalid admin token":                             "Jeton d'administration invalide",
+		"Use POST to flush caches":                        "Utilisez POST pour vider les caches",
+		"Use GET to view or POST to update feature flags": "Utilisez GET pour consulter ou POST pour modifier les feature flags",
+		"Internal proxy error":                            "Erreur interne du proxy",
+	},
+}
+
+// errorLanguage picks the preferred Accept-Language with built-in translations, falling back to
+// DEFAULT_ERROR_LANGUAGE
+func errorLanguage(r *http.Request) string {
+	best, bestQ := defaultErrorLanguage, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := errorMessages[lang]; !ok && lang != "en" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > bestQ {
+			best, bestQ = lang, q
+		}
+	}
+	return best
+}
+
+// localizeError translates a fixed error message into the client's language, keeping the English
+// text when there is no translation
+func localizeError(r *http.Request, message string) string {
+	if translated, ok := errorMessages[errorLanguage(r)][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// writeOpenAIError writes an error in the OpenAI error envelope format, in the client's language
+// when the message has a translation
+func writeOpenAIError(w http.ResponseWriter, r *http.Request, status int, message, errType string) {
+	message = localizeError(r, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(ErrorResponse{
+		Error: ErrorDetail{
+			Message: message,
+			Type:    errType,
+		},
+	})
+}
+
+// isHTTPS reports whether the client reached the proxy over TLS, directly or through a
+// TLS-terminating reverse proxy that sets X-Forwarded-Proto
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// enforceHTTPS applies HSTS_ENABLED, reporting whether the request was redirected
+func enforceHTTPS(w http.ResponseWriter, r *http.Request) bool {
+	if isHTTPS(r) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		return false
+	}
+	// 308 keeps the method and body, so redirected POSTs are replayed as POSTs
+	http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	return true
+}
+
+func enableCors(w http.ResponseWriter) {
+	if !corsEnabled {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Proxy-Warnings, X-Estimated-Cost-USD, X-Experiment-Variant, X-Proxy-Transforms, X-Request-ID, X-Upstream-Request-ID, X-JSON-Mode-Invalid, X-Proxy-Version")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+// PromptRecord is one sampled prompt/response pair written to the prompt log
+type PromptRecord struct {
+	Time     time.Time `json:"time"`
+	Model    string    `json:"model"`
+	Stream   bool      `json:"stream"`
+	Messages []Message `json:"messages"`
+	Response string    `json:"response"`
+	Usage    Usage     `json:"usage"`
+}
+
+// PromptSink receives sampled prompt records
+type PromptSink interface {
+	Write(record PromptRecord) error
+}
+
+// filePromptSink appends records as JSON lines to a file
+type filePromptSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *filePromptSink) Write(record PromptRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// webhookPromptSink posts each record as JSON to a URL
+type webhookPromptSink struct {
+	url string
+}
+
+func (s *webhookPromptSink) Write(record PromptRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("prompt webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// mutateRequest posts a request body to REQUEST_WEBHOOK_URL and returns the body to forward.
+// The webhook answers 200 with a replacement request or 204 to leave it unchanged.
+func mutateRequest(ctx context.Context, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", requestWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return body, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("request webhook returned status %d", resp.StatusCode)
+	}
+	mutated, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(mutated) {
+		return nil, errors.New("request webhook returned invalid JSON")
+	}
+	return mutated, nil
+}
+
+// newPromptSink opens a file sink, or a webhook sink for http(s) URLs
+func newPromptSink(target string) (PromptSink, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &webhookPromptSink{url: target}, nil
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &filePromptSink{file: file}, nil
+}
+
+// redactedText replaces text with a placeholder that keeps only its length
+func redactedText(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("[REDACTED %d chars]", len(s))
+}
+
+// logPromptRecord writes a sampled request to the prompt sink, honoring LOG_PROMPTS=redacted
+func logPromptRecord(info *requestInfo, response string) {
+	record := PromptRecord{
+		Time:     info.receivedAt,
+		Model:    info.model,
+		Stream:   info.stream,
+		Messages: info.messages,
+		Response: response,
+		Usage:    info.usage,
+	}
+	if logPrompts == "redacted" {
+		record.Messages = make([]Message, len(info.messages))
+		for i, msg := range info.messages {
+			record.Messages[i] = Message{Role: msg.Role, Content: redactedText(msg.Content), Name: msg.Name}
+		}
+		record.Response = redactedText(response)
+	}
+
+	// Never hold up the response on the sink
+	sink := promptSink
+	go func() {
+		if err := sink.Write(record); err != nil {
+			log.Printf("Error writing prompt log: %v", err)
+		}
+	}()
+}
+
+// statusRecorder captures the response status while keeping streaming support
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        *bytes.Buffer // copy of the response body when RECORD_DIR is set
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	if rec.body != nil {
+		rec.body.Write(data)
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequestSummary logs one line per request, with full details only when it exceeded SLOW_REQUEST_MS
+func logRequestSummary(r *http.Request, info *requestInfo, status int) {
+	elapsed := time.Since(info.receivedAt)
+	if elapsed < slowRequestThreshold {
+		log.Printf("Request completed: %s %s status=%d duration=%s", r.Method, r.URL.Path, status, elapsed.Round(time.Millisecond))
+		return
+	}
+	log.Printf("Slow request: %s %s status=%d duration=%s model=%s stream=%v prompt_tokens=%d completion_tokens=%d total_tokens=%d",
+		r.Method, r.URL.Path, status, elapsed.Round(time.Millisecond), info.model, info.stream,
+		info.usage.PromptTokens, info.usage.CompletionTokens, info.usage.TotalTokens)
+}
+
+// parseBearer extracts the token from an Authorization header, accepting any
+// capitalization of the scheme and extra whitespace around the token
+func parseBearer(header string) (string, bool) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// requestID returns the client's X-Request-ID when it is a sensible identifier, or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 && strings.IndexFunc(id, func(c rune) bool {
+		return c <= ' ' || c > '~'
+	}) < 0 {
+		return id
+	}
+	buf := make([]byte, 16)
+	crand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// requestInfo carries per-request state through the handlers
+type requestInfo struct {
+	receivedAt time.Time
+	requestID  string
+	warnings   []string
+
+	// Parameter schemas of the request's tools, by function name
+	toolSchemas map[string]interface{}
+
+	// Sampled for the prompt log
+	logPrompt bool
+	messages  []Message
+
+	// Transforms applied to this request, for X-Proxy-Transforms
+	transforms []string
+
+	// Add the upstream's raw body to the converted response (X-Debug-Raw-Response)
+	debugRawResponse bool
+
+	// Set when the response must be stored under an Idempotency-Key
+	idempotencyKey string
+	requestHash    string
+
+	// A hedged second upstream request was sent
+	hedged bool
+	// Tokens the upstream used to summarize the conversation, charged to the quota as well
+	summaryTokens int
+
+	// Model as the client named it, reported back in streamed chunks
+	requestedModel string
+
+	// The client asked for response_format json_object
+	jsonMode bool
+	// The client declared functions rather than tools
+	legacyFunctions bool
+
+	// Stream flush strategy, "immediate" or "batched"
+	flush string
+
+	// Client and upstream request bodies and the uncompressed response body, kept for RECORD_DIR
+	clientBody   []byte
+	upstreamBody []byte
+	responseBody []byte
+
+	// Filled in as the request is processed, for the request summary log
+	model        string
+	stream       bool
+	promptTokens int // estimated
+	usage        Usage
+}
+
+// warn records a non-fatal request processing warning for the X-Proxy-Warnings header
+func (info *requestInfo) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	debugLog("Request warning: %s", warning)
+	info.warnings = append(info.warnings, warning)
+}
+
+// estimateUsage fills in usage from the estimated prompt tokens and the completion length in bytes
+func (info *requestInfo) estimateUsage(completionBytes int) {
+	info.usage.CompletionTokens = completionBytes/4 + 1
+	info.usage.PromptTokens = info.promptTokens
+	info.usage.TotalTokens = info.usage.PromptTokens + info.usage.CompletionTokens
+}
+
+// transformed records that a named transform changed the request or response, for X-Proxy-Transforms
+func (info *requestInfo) transformed(name string) {
+	for _, existing := range info.transforms {
+		if existing == name {
+			return
+		}
+	}
+	info.transforms = append(info.transforms, name)
+}
+
+// setTransformsHeader lists the transforms applied so far when TRANSFORM_TRACE is enabled
+func setTransformsHeader(w http.ResponseWriter, info *requestInfo) {
+	if flags().TransformTrace && len(info.transforms) > 0 {
+		w.Header().Set("X-Proxy-Transforms", strings.Join(info.transforms, ", "))
+	}
+}
+
+// recordRequestTransforms notes the transforms buildDeepSeekRequest applied to the messages and fields
+func recordRequestTransforms(info *requestInfo, chatReq ChatRequest, deepseekReq DeepSeekRequest) {
+	injected := 0
+	if _, ok := defaultSystemMessages[deepseekReq.Model]; ok && !hasSystemMessage(chatReq.Messages) {
+		injected = 1
+		info.transformed("default-system-message")
+	}
+	if len(deepseekReq.Messages) < len(chatReq.Messages)+injected {
+		info.transformed("merge-messages")
+	}
+	for _, msg := range chatReq.Messages {
+		if msg.Role == "developer" && flags().DeveloperRoleAsSystem {
+			info.transformed("developer-role")
+		}
+		if flags().SanitizeControlChars && stripControlChars(msg.Content) != msg.Content {
+			info.transformed("sanitize-control-chars")
+		}
+		if msg.Role == "function" {
+			info.transformed("function-role")
+		}
+	}
+	if len(chatReq.Functions) > 0 && len(chatReq.Tools) == 0 {
+		info.transformed("functions-to-tools")
+	}
+	if !bytes.Equal(chatReq.Extra["stop"], deepseekReq.Extra["stop"]) {
+		info.transformed("stop-trim")
+	}
+	if (chatReq.Temperature != nil && *chatReq.Temperature != *deepseekReq.Temperature) ||
+		!bytes.Equal(chatReq.Extra["top_p"], deepseekReq.Extra["top_p"]) {
+		info.transformed("param-clamp")
+	}
+	if chatReq.MaxTokens != nil && *chatReq.MaxTokens != deepseekReq.MaxTokens {
+		info.transformed("max-tokens-clamp")
+	}
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the state attached to a request by proxyHandler
+func requestInfoFrom(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{receivedAt: time.Now()}
+}
+
+// recoverPanics turns a panic in next into a logged 500 error, so one malformed request
+// cannot take down the whole server
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("Panic handling request %s: %v\n%s", w.Header().Get("X-Request-ID"), v, debug.Stack())
+			requestStats.errors.Add(1)
+			if rec.wroteHeader {
+				// Too late for an error response; drop the connection so the client sees a failure
+				panic(http.ErrAbortHandler)
+			}
+			writeOpenAIError(w, r, http.StatusInternalServerError, "Internal proxy error", "server_error")
+		}()
+		next(rec, r)
+	}
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	debugLog("Received request: %s %s", r.Method, r.URL.Path)
+
+	info := &requestInfo{receivedAt: time.Now(), requestID: requestID(r)}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+	w.Header().Set("X-Request-ID", info.requestID)
+	w.Header().Set("X-Proxy-Version", version)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	if recordDir != "" {
+		rec.body = &bytes.Buffer{}
+	}
+	w = rec
+	// Inner requests are counted as part of the client request they serve
+	inner := r.Context().Value(innerRequestKey{}) != nil
+	if !inner {
+		requestStats.total.Add(1)
+		requestStats.inFlight.Add(1)
+	}
+	defer func() {
+		if !inner {
+			requestStats.inFlight.Add(-1)
+			if rec.status >= 400 {
+				requestStats.errors.Add(1)
+			}
+		}
+		if info.upstreamBody != nil && rec.body != nil {
+			// Complete bodies are recorded as written, before any gzip compression
+			response := rec.body.Bytes()
+			if info.responseBody != nil {
+				response = info.responseBody
+			}
+			if err := recordExchange(recordDir, info, rec.status, response); err != nil {
+				log.Printf("Error recording request: %v", err)
+			}
+		}
+		if slowRequestThreshold > 0 {
+			logRequestSummary(r, info, rec.status)
+		}
+	}()
+
+	// Reject oversized header sets before doing any work with them, on every route
+	if !headersWithinLimits(r.Header) {
+		log.Printf("Request headers exceed configured limits")
+		http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	// Health checks often come over plain HTTP from the load balancer itself
+	if hstsEnabled && r.URL.Path != "/health" && enforceHTTPS(w, r) {
+		return
+	}
+
+	// Answer CORS preflights on every route, before authentication
+	if r.Method == "OPTIONS" {
+		enableCors(w)
+		if corsEnabled {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	enableCors(w)
+
+	// Liveness check for load balancers, answered without authentication
+	if r.URL.Path == "/health" {
+		handleHealthRequest(w, r)
+		return
+	}
+
+	// Operator endpoints, authenticated with ADMIN_TOKEN instead of a client key
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		handleAdminRequest(w, r)
+		return
+	}
+
+	// Anthropic clients send their key in x-api-key
+	if anthropicMessages && r.URL.Path == "/v1/messages" && r.Header.Get("Authorization") == "" {
+		if key := r.Header.Get("X-Api-Key"); key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+
+	// Validate client credentials
+	userAPIKey, cfg, err := authenticator.Authenticate(r)
+	if err == errMissingCredentials {
+		debugLog("Missing or invalid Authorization header")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Invalid API key provided")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	info.flush = flushStrategy(r, cfg)
+
+	// Allow selecting a configured upstream per request, unless tenants have their own upstreams
+	if upstream := r.Header.Get("X-Upstream"); upstream != "" {
+		if _, static := configResolver.(staticResolver); !static {
+			log.Printf("Rejected X-Upstream %q: tenants are pinned to their own upstreams", upstream)
+			http.Error(w, "Invalid X-Upstream: not available with per-tenant upstreams", http.StatusBadRequest)
+			return
+		}
+		selected, err := selectUpstream(upstream)
+		if err != nil {
+			log.Printf("Rejected X-Upstream %q: %v", upstream, err)
+			http.Error(w, fmt.Sprintf("Invalid X-Upstream: %v", err), http.StatusBadRequest)
+			return
+		}
+		cfg = selected
+		log.Printf("X-Upstream selected endpoint: %s", cfg.endpoint)
+	} else if _, static := configResolver.(staticResolver); static && len(healthAwareUpstreams) > 0 {
+		cfg = selectHealthyUpstream(healthAwareUpstreams)
+	}
+
+	// Handle the batch extension endpoint
+	if r.URL.Path == "/v1/chat/completions/batch" && r.Method == "POST" {
+		handleBatchRequest(w, r)
+		return
+	}
+
+	// Translate Anthropic Messages API requests
+	if anthropicMessages && r.URL.Path == "/v1/messages" && r.Method == "POST" {
+		handleAnthropicRequest(w, r)
+		return
+	}
+
+	// Handle /v1/models endpoint; for HEAD the body is discarded by net/http
+	if r.URL.Path == "/v1/models" && (r.Method == "GET" || r.Method == "HEAD") {
+		log.Printf("Handling /v1/models request")
+		handleModelsRequest(w)
+		return
+	}
+
+	// No other endpoint answers HEAD
+	if r.Method == "HEAD" {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Embeddings never stream: forward them as plain JSON even if the client asked to stream
+	if r.URL.Path == "/v1/embeddings" && r.Method == "POST" {
+		handleEmbeddingsRequest(w, r, cfg)
+		return
+	}
+
+	// Log headers for debugging
+	debugLog("Request headers: %+v", r.Header)
+
+	// Read and log request body for debugging
+	var chatReq ChatRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		debugLog("Error reading request body: %v", err)
+		http.Error(w, "Error reading request", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	// Switch slow non-streaming requests to SSE once STREAM_UPGRADE_MS has passed. This comes
+	// first so that capturing, the request webhook and the quota only see the inner request
+	if streamUpgradeAfter > 0 && strings.HasPrefix(r.URL.Path, "/v1/") && r.Context().Value(noStreamUpgradeKey{}) == nil {
+		var upgradeReq ChatRequest
+		if err := json.Unmarshal(body, &upgradeReq); err == nil && !upgradeReq.Stream {
+			streamUpgrade(w, r, body)
+			return
+		}
+	}
+
+	if captureDir != "" {
+		if err := captureRequest(captureDir, body); err != nil {
+			log.Printf("Error capturing request: %v", err)
+		}
+	}
+
+	// Let the policy webhook rewrite the request before anything else looks at it
+	if requestWebhookURL != "" {
+		mutated, err := mutateRequest(r.Context(), body)
+		switch {
+		case err == nil:
+			if !bytes.Equal(mutated, body) {
+				info.transformed("request-webhook")
+			}
+			body = mutated
+			r.Body = io.NopCloser(bytes.NewBuffer(body))
+		case requestWebhookFailMode == "open":
+			log.Printf("Request webhook failed, forwarding the request unchanged: %v", err)
+		default:
+			log.Printf("Request webhook failed: %v", err)
+			writeOpenAIError(w, r, http.StatusBadGateway, "Request policy webhook is unavailable.", "request_webhook_error")
+			return
+		}
+	}
+
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		log.Printf("Error parsing request JSON: %v", err)
+		log.Printf("Raw request body: %s", logBody(body))
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Parsed request: %s", logBody([]byte(fmt.Sprintf("%+v", chatReq))))
+
+	// Handle models endpoint
+	if r.URL.Path == "/v1/models" {
+		handleModelsRequest(w)
+		return
+	}
+
+	// Only handle API requests with /v1/ prefix
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		log.Printf("Invalid path: %s", r.URL.Path)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// Restore the body for further reading
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	// Enforce the client's token quota, charging what this request uses once it completes
+	if quotaStore != nil {
+		used, resetAt := quotaStore.Used(userAPIKey, time.Now())
+		if used >= tokenQuota {
+			log.Printf("Client %s exceeded its token quota (%d of %d tokens)", truncateString(userAPIKey, 4), used, tokenQuota)
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+			writeOpenAIError(w, r, http.StatusTooManyRequests, "Token quota exceeded for this API key. Try again after the quota window resets.", "insufficient_quota")
+			return
+		}
+		defer func() {
+			tokens := info.usage.TotalTokens
+			// The upstream may bill the losing side of a hedge in full as well
+			if info.hedged {
+				tokens *= 2
+			}
+			if tokens += info.summaryTokens; tokens > 0 {
+				quotaStore.Add(userAPIKey, tokens, time.Now())
+			}
+		}()
+	}
+
+	log.Printf("Request body: %s", logBody(body))
+
+	// Parse the request to check for streaming - reuse existing chatReq
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		log.Printf("Error parsing request JSON: %v", err)
+		http.Error(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Requested model: %s", chatReq.Model)
+	info.requestedModel = chatReq.Model
+
+	// Replace gpt-4o model with the appropriate deepseek model
+	if chatReq.Model == gpt4oModel {
+		log.Printf("Converting gpt-4o to configured model: %s (endpoint: %s)", cfg.model, cfg.endpoint)
+		chatReq.Model = cfg.model
+		log.Printf("Model converted to: %s", cfg.model)
+		info.warn("model remapped to %s", cfg.model)
+		info.transformed("model-remap")
+	} else if chatReq.Model == cfg.model {
+		log.Printf("Requested model matches configured model: %s", cfg.model)
+	} else {
+		log.Printf("Unsupported model requested: %s", chatReq.Model)
+		http.Error(w, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, gpt4oModel), http.StatusBadRequest)
+		return
+	}
+
+	// Catch conversations DeepSeek would reject with an unhelpful error
+	if err := validateMessages(chatReq.Messages); err != nil {
+		log.Printf("Rejected request: %v", err)
+		writeOpenAIError(w, r, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	// Summarize the oldest messages of conversations above the token budget
+	if conversationTokenBudget > 0 {
+		compacted, err := compactConversation(r.Context(), cfg, chatReq.Messages, conversationTokenBudget)
+		if err != nil {
+			log.Printf("Error summarizing conversation, forwarding it in full: %v", err)
+		} else if len(compacted) != len(chatReq.Messages) {
+			chatReq.Messages = compacted
+			info.transformed("summarize")
+		}
+	}
+
+	// Bucket clients into the model variants of the A/B experiment
+	var variant string
+	if len(experimentVariants) > 0 {
+		bucketKey := userAPIKey
+		var user string
+		if err := json.Unmarshal(chatReq.Extra["user"], &user); err == nil && user != "" {
+			bucketKey = user
+		}
+		variant = pickExperimentVariant(bucketKey)
+		cfg.model = variant
+		chatReq.Model = variant
+		info.transformed("ab-variant")
+		log.Printf("Experiment variant for this client: %s", variant)
+	}
+
+	// Route by tool use; prompt size routing below still takes precedence
+	if toolsTarget.model != "" || noToolsTarget.model != "" {
+		var toolRouted bool
+		if cfg, toolRouted = routeByToolUse(cfg, chatReq); toolRouted {
+			chatReq.Model = cfg.model
+			info.transformed("tool-routing")
+			log.Printf("Tool use routing selected model: %s", cfg.model)
+		}
+	}
+
+	// Route by prompt size: explicit rules first, then the large-context switch
+	routed := false
+	if len(routingRules) > 0 {
+		tokens := estimateTokens(chatReq.Messages)
+		if cfg, routed = routeByTokens(cfg, tokens); routed {
+			chatReq.Model = cfg.model
+			info.transformed("routing-rule")
+			log.Printf("Estimated %d prompt tokens, routing rule selected model: %s", tokens, cfg.model)
+		}
+	}
+	if largeContextThreshold > 0 && !routed {
+		if tokens := estimateTokens(chatReq.Messages); tokens > largeContextThreshold {
+			cfg = largeContextConfig(cfg)
+			chatReq.Model = cfg.model
+			info.transformed("large-context")
+			log.Printf("Estimated %d prompt tokens exceeds %d, using large-context model: %s", tokens, largeContextThreshold, cfg.model)
+		}
+	}
+
+	// Refuse models the operator has blocked, whichever way the request resolved to them
+	if blockedModels[cfg.model] {
+		log.Printf("Rejected request for blocked model: %s", cfg.model)
+		writeOpenAIError(w, r, http.StatusForbidden, fmt.Sprintf("Model %s is not available through this proxy.", cfg.model), "permission_error")
+		return
+	}
+
+	// Report the variant only if routing did not replace its model
+	if variant != "" {
+		if cfg.model == variant {
+			w.Header().Set("X-Experiment-Variant", variant)
+		} else {
+			log.Printf("Experiment variant %s overridden by routing to %s", variant, cfg.model)
+			info.warn("experiment variant %s overridden by routing to %s", variant, cfg.model)
+		}
+	}
+
+	info.model = cfg.model
+	info.stream = chatReq.Stream
+	info.legacyFunctions = len(chatReq.Functions) > 0 && len(chatReq.Tools) == 0
+	var responseFormat struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(chatReq.Extra["response_format"], &responseFormat) == nil {
+		info.jsonMode = responseFormat.Type == "json_object"
+	}
+	if promptSink != nil && rand.Float64() < promptSampleRate {
+		info.logPrompt = true
+		info.messages = chatReq.Messages
+	}
+	if flags().ValidateToolArguments {
+		info.toolSchemas = make(map[string]interface{})
+		for _, tool := range chatReq.Tools {
+			info.toolSchemas[tool.Function.Name] = tool.Function.Parameters
+		}
+		for _, fn := range chatReq.Functions {
+			info.toolSchemas[fn.Name] = fn.Parameters
+		}
+	}
+	info.promptTokens = estimateTokens(chatReq.Messages)
+
+	// Include the raw upstream body for operators holding the admin token
+	if r.Header.Get("X-Debug-Raw-Response") == "true" {
+		token := r.Header.Get("X-Debug-Token")
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			info.debugRawResponse = true
+		} else {
+			info.warn("X-Debug-Raw-Response ignored without a valid X-Debug-Token")
+		}
+	}
+
+	// Convert to DeepSeek request format
+	deepseekReq, err := buildDeepSeekRequest(chatReq, cfg)
+	if err != nil {
+		log.Printf("Rejected request: %v", err)
+		writeOpenAIError(w, r, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	recordRequestTransforms(info, chatReq, deepseekReq)
+
+	// Answer retried requests with the response stored for their idempotency key
+	if key := r.Header.Get("Idempotency-Key"); key != "" && idempotencyCache != nil && !chatReq.Stream {
+		info.idempotencyKey = userAPIKey + "\x00" + key
+		info.requestHash = requestHash(deepseekReq)
+		if cached, ok := idempotencyCache.Get(info.idempotencyKey); ok {
+			if cached.requestHash != info.requestHash {
+				log.Printf("Idempotency key %s reused with a different request", key)
+				writeOpenAIError(w, r, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request", "invalid_request_error")
+				return
+			}
+			log.Printf("Returning stored response for idempotency key: %s", key)
+			info.transformed("cache-hit")
+			setTransformsHeader(w, info)
+			writeCachedResponse(w, r, cached, "Idempotent-Replayed")
+			return
+		}
+	}
+
+	// Create new request body
+	modifiedBody, err := json.Marshal(deepseekReq)
+	if err != nil {
+		log.Printf("Error creating modified request body: %v", err)
+		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
+		return
+	}
+
+	// Forward the client's body untouched when the conversion would not change it,
+	// preserving field order and fields the proxy does not model
+	if unchangedByConversion(body, deepseekReq) {
+		log.Printf("Request needs no conversion, forwarding original body")
+		modifiedBody = body
+	} else {
+		for _, field := range unsupportedFields(body) {
+			info.warn("dropped %s", field)
+		}
+	}
+	if recordDir != "" {
+		info.clientBody, info.upstreamBody = body, modifiedBody
+	}
+
+	log.Printf("Modified request body: %s", logBody(modifiedBody))
+
+	// Create the proxy request to DeepSeek
+	targetURL := upstreamURL(cfg, r.URL.Path, r.URL.RawQuery)
+
+	log.Printf("Using endpoint %s with model %s", cfg.endpoint, cfg.model)
+	log.Printf("Forwarding to: %s", targetURL)
+	// Bound streams by STREAM_TIMEOUT_MS; the upstream read is cancelled when it fires
+	if chatReq.Stream && streamTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), streamTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// Bound other completions by COMPLETION_TIMEOUT_SECONDS, retries and fallbacks included
+	if !chatReq.Stream && completionTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), completionTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	proxyReq, err := newProxyRequest(r, cfg, targetURL, modifiedBody, chatReq.Stream)
+	if err != nil {
+		log.Printf("Error creating proxy request: %v", err)
+		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+		return
+	}
+
+	if len(info.warnings) > 0 {
+		w.Header().Set("X-Proxy-Warnings", strings.Join(info.warnings, "; "))
+	}
+
+	// Builds another copy of the upstream request with a fresh body
+	buildRequest := func() (*http.Request, error) {
+		return newProxyRequest(r, cfg, targetURL, modifiedBody, chatReq.Stream)
+	}
+
+	// Re-issues the upstream request
+	reissue := func() (*http.Response, error) {
+		retryReq, err := buildRequest()
+		if err != nil {
+			return nil, err
+		}
+		return sendUpstream(cfg.name, retryReq)
+	}
+
+	// Use the global client instead of creating a new one
+	var resp *http.Response
+	// Only hedge requests the client marked as safe to repeat
+	if hedgeDelay > 0 && !chatReq.Stream && r.Header.Get("Idempotency-Key") != "" {
+		resp, info.hedged, err = hedgedSend(cfg.name, proxyReq, buildRequest, hedgeDelay)
+	} else {
+		resp, err = sendUpstream(cfg.name, proxyReq)
+	}
+
+	// Nothing has reached the client before the stream is set up, so retrying is safe
+	if chatReq.Stream {
+		resp, err = retryStreamSetup(r.Context(), resp, err, reissue)
+	}
+	if err != nil {
+		log.Printf("Error forwarding request: %v", err)
+		http.Error(w, "Error forwarding request", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Printf("DeepSeek response status: %d", resp.StatusCode)
+	log.Printf("DeepSeek response headers: %v", resp.Header)
+
+	// Retry context-length failures once against the large-context model
+	if flags().ContextFallback && resp.StatusCode == http.StatusBadRequest {
+		if fallbackResp, ok := retryWithLargeContext(r, resp, chatReq, cfg); ok {
+			resp = fallbackResp
+			defer resp.Body.Close()
+			info.transformed("context-fallback")
+		}
+	}
+	setTransformsHeader(w, info)
+
+	// Link the proxy's request ID to the upstream's for support tickets
+	upstreamRequestID := resp.Header.Get("X-Request-ID")
+	if upstreamRequestID != "" {
+		log.Printf("Request %s maps to upstream request %s", info.requestID, upstreamRequestID)
+		if exposeUpstreamRequestID {
+			w.Header().Set("X-Upstream-Request-ID", upstreamRequestID)
+		}
+	}
+
+	// Handle error responses
+	if resp.StatusCode >= 400 {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("Error reading error response: %v", err)
+			http.Error(w, "Error reading response", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("DeepSeek error response: %s", logBody(respBody))
+
+		// Streaming clients can be sent the error as an event on a 200 stream instead
+		if chatReq.Stream && streamErrorEvents {
+			message, errType := upstreamErrorMessage(resp.StatusCode, respBody)
+			writeStreamError(w, r, message, errType)
+			return
+		}
+
+		// A rejected upstream key is the proxy's problem; a forwarded 401 would blame the client's key
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			log.Printf("Upstream %s rejected the proxy's credentials with status %d", cfg.endpoint, resp.StatusCode)
+			writeOpenAIError(w, r, http.StatusBadGateway, "The upstream provider rejected the proxy's API key. This is a proxy configuration problem, not an issue with your client key.", "upstream_auth_error")
+			return
+		}
+
+		// Forward the error response, keeping the proxy's own request ID
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Request-ID", info.requestID)
+
+		// Wrap non-JSON bodies (e.g. gateway HTML pages) so SDK clients can parse them
+		if !json.Valid(respBody) {
+			log.Printf("Wrapping non-JSON upstream error body in OpenAI error envelope")
+			w.Header().Del("Content-Length")
+			message := strings.TrimSpace(string(respBody))
+			if message == "" {
+				message = http.StatusText(resp.StatusCode)
+			}
+			writeOpenAIError(w, r, resp.StatusCode, truncateString(message, 1024), "upstream_error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBody)
+		return
+	}
+
+	// Handle streaming response
+	if chatReq.Stream {
+		handleStreamingResponse(w, r, resp, reissue)
+		return
+	}
+
+	// Handle regular response
+	handleRegularResponse(w, r, resp, reissue)
+}
+
+// newProxyRequest builds the upstream request for a converted body, carrying over client headers
+func newProxyRequest(r *http.Request, cfg Config, targetURL string, body []byte, stream bool) (*http.Request, error) {
+	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers
+	copyHeaders(proxyReq.Header, r.Header)
+
+	// Never forward client credentials or attribution; the proxy sets its own below
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "HTTP-Referer", "X-Title", "X-Debug-Token"} {
+		proxyReq.Header.Del(name)
+	}
+
+	// Pass the request ID on so upstream logs can be matched with the proxy's
+	proxyReq.Header.Set("X-Request-ID", requestInfoFrom(r).requestID)
+
+	// Set DeepSeek API key and content type
+	proxyReq.Header.Set("Authorization", "Bearer "+cfg.apiKey)
+	proxyReq.Header.Set("Content-Type", "application/json")
+
+	// Add OpenRouter-specific headers if using OpenRouter
+	if cfg.endpoint == openRouterEndpoint {
+		referer, title := cfg.referer, cfg.title
+		if referer == "" {
+			referer = openRouterReferer
+		}
+		if title == "" {
+			title = openRouterTitle
+		}
+		proxyReq.Header.Set("HTTP-Referer", referer)
+		proxyReq.Header.Set("X-Title", title)
+	}
+
+	if stream {
+		proxyReq.Header.Set("Accept", "text/event-stream")
+	}
+
+	// Add Accept-Language header from request, falling back to DEFAULT_ACCEPT_LANGUAGE
+	acceptLanguage := r.Header.Get("Accept-Language")
+	if acceptLanguage == "" {
+		acceptLanguage = defaultAcceptLanguage
+	}
+	if acceptLanguage != "" {
+		proxyReq.Header.Set("Accept-Language", acceptLanguage)
+	}
+
+	log.Printf("Proxy request headers: %v", proxyReq.Header)
+
+	return proxyReq, nil
+}
+
+// sendUpstream performs an upstream request to the named upstream, answering locally in
+// FAKE_UPSTREAM mode. Every attempt counts towards the upstream's health, except those the
+// proxy cancelled itself, such as the losing side of a hedge.
+func sendUpstream(name string, req *http.Request) (*http.Response, error) {
+	if fakeUpstream {
+		return fakeUpstreamResponse(req)
+	}
+	resp, err := httpClient.Do(req)
+	if !errors.Is(err, context.Canceled) {
+		upstreamStats.record(name, err == nil && resp.StatusCode < 500)
+	}
+	return resp, err
+}
+
+// fakeUpstreamResponse returns a deterministic canned completion without dialing the upstream
+func fakeUpstreamResponse(req *http.Request) (*http.Response, error) {
+	var deepseekReq DeepSeekRequest
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&deepseekReq); err != nil {
+			return nil, fmt.Errorf("fake upstream: invalid request body: %w", err)
+		}
+		req.Body.Close()
+	}
+
+	const content = "This is a canned response from the fake upstream."
+	header := make(http.Header)
+	var body []byte
+
+	if deepseekReq.Stream {
+		header.Set("Content-Type", "text/event-stream")
+		var buf bytes.Buffer
+		for _, word := range strings.SplitAfter(content, " ") {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"id":      "fake-completion",
+				"object":  "chat.completion.chunk",
+				"created": 0,
+				"model":   deepseekReq.Model,
+				"choices": []map[string]interface{}{
+					{"index": 0, "delta": map[string]string{"content": word}, "finish_reason": nil},
+				},
+			})
+			fmt.Fprintf(&buf, "data: %s\n\n", chunk)
+		}
+		final, _ := json.Marshal(map[string]interface{}{
+			"id":      "fake-completion",
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   deepseekReq.Model,
+			"choices": []map[string]interface{}{
+				{"index": 0, "delta": map[string]string{}, "finish_reason": "stop"},
+			},
+		})
+		fmt.Fprintf(&buf, "data: %s\n\ndata: [DONE]\n\n", final)
+		body = buf.Bytes()
+	} else {
+		header.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(map[string]interface{}{
+			"id":      "fake-completion",
+			"object":  "chat.completion",
+			"created": 0,
+			"model":   deepseekReq.Model,
+			"choices": []map[string]interface{}{
+				{"index": 0, "message": map[string]string{"role": "assistant", "content": content}, "finish_reason": "stop"},
+			},
+			"usage": map[string]int{
+				"prompt_tokens":     estimateTokens(deepseekReq.Messages),
+				"completion_tokens": len(strings.Fields(content)),
+				"total_tokens":      estimateTokens(deepseekReq.Messages) + len(strings.Fields(content)),
+			},
+		})
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// retryableSetupStatus reports whether an upstream status is a transient gateway failure
+func retryableSetupStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Upper bound for a single jittered retry delay
+const maxRetryBackoff = 30 * time.Second
+
+// retryBackoff returns the delay before the given retry: STREAM_SETUP_RETRY_DELAY_MS, or with
+// RETRY_JITTER a random delay between zero and the exponentially growing base, so clients
+// that failed together do not retry together
+func retryBackoff(attempt int) time.Duration {
+	if !retryJitter || streamSetupRetryDelay <= 0 {
+		return streamSetupRetryDelay
+	}
+	ceiling := streamSetupRetryDelay
+	for i := 1; i < attempt && ceiling < maxRetryBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > maxRetryBackoff {
+		ceiling = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryStreamSetup retries a streaming request that failed to connect or got a transient
+// gateway status, up to STREAM_SETUP_RETRIES times and within RETRY_MAX_ELAPSED_MS.
+// Only used before any bytes reach the client.
+func retryStreamSetup(ctx context.Context, resp *http.Response, err error, reissue upstreamRequester) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; attempt <= streamSetupRetries; attempt++ {
+		if err == nil && !retryableSetupStatus(resp.StatusCode) {
+			break
+		}
+		delay := retryBackoff(attempt)
+		if retryMaxElapsed > 0 && time.Since(start)+delay > retryMaxElapsed {
+			log.Printf("Streaming setup retries stopped after %s, retry budget of %s exhausted", time.Since(start).Round(time.Millisecond), retryMaxElapsed)
+			break
+		}
+		if err != nil {
+			log.Printf("Streaming setup failed: %v (retry %d/%d)", err, attempt, streamSetupRetries)
+		} else {
+			log.Printf("Streaming setup got status %d (retry %d/%d)", resp.StatusCode, attempt, streamSetupRetries)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		resp, err = reissue()
+	}
+	return resp, err
+}
+
+// hedgeResult is the outcome of one hedged upstream attempt
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+}
+
+// cancelOnClose cancels an attempt's context once its winning response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// hedgedSend sends first to the named upstream and, if no response arrived within delay, an
+// identical second request built by build. The first successful response wins and the other
+// attempt is cancelled. It also reports whether the second request was sent.
+func hedgedSend(name string, first *http.Request, build func() (*http.Request, error), delay time.Duration) (*http.Response, bool, error) {
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+
+	launch := func(req *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		attempt := len(cancels) - 1
+		go func() {
+			resp, err := sendUpstream(name, req.WithContext(ctx))
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err}
+		}()
+	}
+
+	launch(first)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending := 1
+	var res hedgeResult
+	select {
+	case res = <-results:
+		pending--
+	case <-timer.C:
+		if hedgeReq, err := build(); err != nil {
+			log.Printf("Error creating hedged request: %v", err)
+		} else {
+			log.Printf("No upstream response after %s, sending hedged request", delay)
+			launch(hedgeReq)
+			pending++
+		}
+		res = <-results
+		pending--
+	}
+
+	// Prefer a successful attempt when the first one to finish failed, and any upstream
+	// response over a transport error
+	if (res.err != nil || res.resp.StatusCode >= 500) && pending > 0 {
+		other := <-results
+		pending--
+		if other.err == nil && (res.err != nil || other.resp.StatusCode < 500) {
+			if res.err == nil {
+				res.resp.Body.Close()
+			}
+			res = other
+		} else if other.err == nil {
+			other.resp.Body.Close()
+		}
+	}
+
+	// Cancel every other attempt and release a late response
+	for i, cancel := range cancels {
+		if i != res.attempt {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		go func() {
+			if late := <-results; late.err == nil {
+				late.resp.Body.Close()
+			}
+		}()
+	}
+
+	hedged := len(cancels) > 1
+	if res.err != nil {
+		cancels[res.attempt]()
+		return nil, hedged, res.err
+	}
+	if res.attempt > 0 {
+		log.Printf("Hedged request won")
+	}
+	res.resp.Body = cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.attempt]}
+	return res.resp, hedged, nil
+}
+
+// isContextLengthError reports whether an upstream error body rejects the prompt as too long
+func isContextLengthError(body []byte) bool {
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil {
+		if errResp.Error.Code != nil && *errResp.Error.Code == "context_length_exceeded" {
+			return true
+		}
+	}
+	lower := strings.ToLower(string(body))
+	return strings.Contains(lower, "context length") || strings.Contains(lower, "context_length")
+}
+
+// retryWithLargeContext re-sends a request rejected for its context length to the
+// large-context model. When no retry happens, resp's body is left readable.
+func retryWithLargeContext(r *http.Request, resp *http.Response, chatReq ChatRequest, cfg Config) (*http.Response, bool) {
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err != nil || !isContextLengthError(respBody) {
+		return nil, false
+	}
+
+	fallbackCfg := largeContextConfig(cfg)
+	if fallbackCfg.model == cfg.model && fallbackCfg.endpoint == cfg.endpoint {
+		log.Printf("Context length exceeded but no larger model is configured")
+		return nil, false
+	}
+	if blockedModels[fallbackCfg.model] {
+		log.Printf("Context length exceeded but the large-context model %s is blocked", fallbackCfg.model)
+		return nil, false
+	}
+	log.Printf("Context length exceeded for %s, retrying with %s", cfg.model, fallbackCfg.model)
+
+	chatReq.Model = fallbackCfg.model
+	deepseekReq, err := buildDeepSeekRequest(chatReq, fallbackCfg)
+	if err != nil {
+		log.Printf("Error building fallback request: %v", err)
+		return nil, false
+	}
+	body, err := json.Marshal(deepseekReq)
+	if err != nil {
+		log.Printf("Error creating fallback request body: %v", err)
+		return nil, false
+	}
+	fallbackReq, err := newProxyRequest(r, fallbackCfg, upstreamURL(fallbackCfg, r.URL.Path, r.URL.RawQuery), body, chatReq.Stream)
+	if err != nil {
+		log.Printf("Error creating fallback request: %v", err)
+		return nil, false
+	}
+	fallbackResp, err := sendUpstream(fallbackCfg.name, fallbackReq)
+	if err != nil {
+		log.Printf("Error forwarding fallback request: %v", err)
+		return nil, false
+	}
+
+	requestInfoFrom(r).model = fallbackCfg.model
+	return fallbackResp, true
+}
+
+// upstreamRequester re-issues the upstream request, used for best-effort stream recovery
+type upstreamRequester func() (*http.Response, error)
+
+// bufferedResponse is an in-memory ResponseWriter used to run batch items through proxyHandler
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// serve runs proxyHandler into the buffer on a background goroutine, where a panic would
+// otherwise crash the process; it replaces whatever was buffered with a 500 error instead
+func (b *bufferedResponse) serve(r *http.Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		log.Printf("Panic handling request %s: %v\n%s", b.header.Get("X-Request-ID"), v, debug.Stack())
+		requestStats.errors.Add(1)
+		b.status = 0
+		b.body.Reset()
+		writeOpenAIError(b, r, http.StatusInternalServerError, "Internal proxy error", "server_error")
+	}()
+	proxyHandler(b, r)
+}
+
+// BatchResult is one entry of a /v1/chat/completions/batch response, aligned with the request array
+type BatchResult struct {
+	Index  int             `json:"index"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// handleBatchRequest runs an array of chat requests concurrently through the regular pipeline
+func handleBatchRequest(w http.ResponseWriter, r *http.Request) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		log.Printf("Error parsing batch request: %v", err)
+		writeOpenAIError(w, r, http.StatusBadRequest, "Batch request must be a JSON array of chat completion requests", "invalid_request_error")
+		return
+	}
+	if len(items) == 0 || len(items) > batchMaxSize {
+		writeOpenAIError(w, r, http.StatusBadRequest, fmt.Sprintf("Batch must contain between 1 and %d requests", batchMaxSize), "invalid_request_error")
+		return
+	}
+
+	log.Printf("Handling batch of %d requests with concurrency %d", len(items), batchConcurrency)
+
+	results := make([]BatchResult, len(items))
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item json.RawMessage) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = runBatchItem(r, i, item)
+		}(i, item)
+	}
+	wg.Wait()
+
+	body, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("Error encoding batch response: %v", err)
+		http.Error(w, "Error creating batch response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, r, http.StatusOK, body)
+}
+
+// runBatchItem sends one batch entry through proxyHandler as a non-streaming completion
+func runBatchItem(r *http.Request, index int, item json.RawMessage) BatchResult {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(item, &fields); err != nil {
+		return batchError(index, http.StatusBadRequest, "Batch entry must be a JSON object")
+	}
+	fields["stream"] = json.RawMessage("false")
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return batchError(index, http.StatusInternalServerError, "Error encoding batch entry")
+	}
+
+	ctx := context.WithValue(r.Context(), noStreamUpgradeKey{}, true)
+	sub, err := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return batchError(index, http.StatusInternalServerError, "Error creating batch entry request")
+	}
+	sub.Header = r.Header.Clone()
+	sub.Header.Del("Accept-Encoding")
+	sub.Header.Del("Idempotency-Key")
+	sub.Header.Del("Content-Length")
+
+	rec := &bufferedResponse{header: make(http.Header)}
+	rec.serve(sub)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	result := BatchResult{Index: index, Status: rec.status, Body: rec.body.Bytes()}
+	if !json.Valid(result.Body) {
+		return batchError(index, rec.status, strings.TrimSpace(rec.body.String()))
+	}
+	return result
+}
+
+// noStreamUpgradeKey marks requests that must be answered without STREAM_UPGRADE_MS,
+// i.e. batch entries and the inner request of an upgrade itself
+type noStreamUpgradeKey struct{}
+
+// innerRequestKey marks a request proxyHandler serves on behalf of a client request it is
+// already handling, such as the inner request of a stream upgrade or a translated Anthropic
+// Messages request
+type innerRequestKey struct{}
+
+// streamUpgrade runs a non-streaming request in the background and relays its response as is
+// when it completes within STREAM_UPGRADE_MS. Otherwise it switches the client to SSE, keeps
+// the connection alive with heartbeats and sends the completion as a single chunk once it arrives.
+func streamUpgrade(w http.ResponseWriter, r *http.Request, body []byte) {
+	ctx := context.WithValue(r.Context(), noStreamUpgradeKey{}, true)
+	sub := r.Clone(context.WithValue(ctx, innerRequestKey{}, true))
+	sub.Body = io.NopCloser(bytes.NewReader(body))
+	sub.Header.Del("Accept-Encoding")
+	sub.Header.Set("X-Request-ID", requestInfoFrom(r).requestID)
+
+	rec := &bufferedResponse{header: make(http.Header)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec.serve(sub)
+	}()
+
+	timer := time.NewTimer(streamUpgradeAfter)
+	defer timer.Stop()
+	select {
+	case <-done:
+		rec.header.Del("Vary")
+		// The client already has its request ID
+		rec.header.Del("X-Request-ID")
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		writeBody(w, r, rec.status, rec.body.Bytes())
+		return
+	case <-timer.C:
+	}
+
+	log.Printf("Request still pending after %v, upgrading client to streaming", streamUpgradeAfter)
+	setStreamHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	// The inner request shares the client's context, so a disconnect also ends it
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-ticker.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				log.Printf("Error sending heartbeat: %v", err)
+				<-done
+				return
+			}
+			flush()
+		}
+	}
+
+	if rec.status != 0 && rec.status != http.StatusOK {
+		message := strings.TrimSpace(rec.body.String())
+		var errResp ErrorResponse
+		if json.Unmarshal(rec.body.Bytes(), &errResp) == nil && errResp.Error.Message != "" {
+			message = errResp.Error.Message
+		}
+		w.Write(sseErrorEvent(message, "upstream_error"))
+		flush()
+		return
+	}
+
+	chunk, err := completionToChunk(rec.body.Bytes())
+	if err != nil {
+		log.Printf("Error converting upgraded response: %v", err)
+		w.Write(sseErrorEvent("Error converting upstream response", "proxy_error"))
+		flush()
+		return
+	}
+	w.Write(append(dataLine(chunk), "\ndata: [DONE]\n\n"...))
+	flush()
+}
+
+// completionToChunk re-encodes a chat.completion as one chat.completion.chunk carrying each
+// message as a delta, with tool calls indexed the way streamed tool call deltas are
+func completionToChunk(body []byte) ([]byte, error) {
+	var completion map[string]interface{}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, err
+	}
+	choices, _ := completion["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		message, _ := choice["message"].(map[string]interface{})
+		if toolCalls, ok := message["tool_calls"].([]interface{}); ok {
+			for i, tc := range toolCalls {
+				if call, ok := tc.(map[string]interface{}); ok {
+					call["index"] = i
+				}
+			}
+		}
+		choice["delta"] = message
+		delete(choice, "message")
+	}
+	completion["object"] = "chat.completion.chunk"
+	return json.Marshal(completion)
+}
+
+// batchError builds a batch entry carrying an OpenAI error envelope
+func batchError(index, status int, message string) BatchResult {
+	body, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Message: message, Type: "invalid_request_error"}})
+	return BatchResult{Index: index, Status: status, Body: body}
+}
+
+// AnthropicRequest is the subset of an Anthropic Messages API request the adapter translates
+type AnthropicRequest struct {
+	Model         string               `json:"model"`
+	System        json.RawMessage      `json:"system"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	MaxTokens     *int                 `json:"max_tokens"`
+	Temperature   *float64             `json:"temperature"`
+	TopP          *float64             `json:"top_p"`
+	StopSequences []string             `json:"stop_sequences"`
+	Stream        bool                 `json:"stream"`
+	Tools         []AnthropicTool      `json:"tools"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice"`
+	Metadata      struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+}
+
+// AnthropicMessage is a conversation turn; content is a string or a list of blocks
+type AnthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// AnthropicBlock is a content block of a message: text, tool_use or tool_result
+type AnthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+}
+
+type AnthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicResponse is a Messages API response
+type AnthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []AnthropicBlock `json:"content"`
+	StopReason   string           `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicBlocks decodes message content given as a string or a list of blocks
+func anthropicBlocks(raw json.RawMessage) ([]AnthropicBlock, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []AnthropicBlock{{Type: "text", Text: text}}, nil
+	}
+	var blocks []AnthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("content must be a string or a list of content blocks")
+	}
+	return blocks, nil
+}
+
+// anthropicText joins the text of a system prompt or tool result, given as a string or blocks
+func anthropicText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	blocks, err := anthropicBlocks(raw)
+	if err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return "", fmt.Errorf("unsupported %s block; only text is supported here", block.Type)
+		}
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// anthropicToChat translates an Anthropic request into the chat completion request the proxy
+// serves. Tool results become tool messages ahead of the user's text, as OpenAI orders them.
+func anthropicToChat(req AnthropicRequest) (map[string]interface{}, error) {
+	var messages []Message
+	system, err := anthropicText(req.System)
+	if err != nil {
+		return nil, fmt.Errorf("system: %w", err)
+	}
+	if system != "" {
+		messages = append(messages, Message{Role: "system", Content: system})
+	}
+
+	for i, msg := range req.Messages {
+		blocks, err := anthropicBlocks(msg.Content)
+		if err != nil {
+			return nil, fmt.Errorf("messages[%d]: %w", i, err)
+		}
+		turn := Message{Role: msg.Role}
+		var texts []string
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				texts = append(texts, block.Text)
+			case "thinking", "redacted_thinking":
+				// Earlier reasoning is not sent back upstream
+			case "tool_use":
+				if msg.Role != "assistant" {
+					return nil, fmt.Errorf("messages[%d]: tool_use blocks belong to assistant messages", i)
+				}
+				call := ToolCall{ID: block.ID, Type: "function"}
+				call.Function.Name = block.Name
+				call.Function.Arguments = string(block.Input)
+				if len(block.Input) == 0 {
+					call.Function.Arguments = "{}"
+				}
+				turn.ToolCalls = append(turn.ToolCalls, call)
+			case "tool_result":
+				result, err := anthropicText(block.Content)
+				if err != nil {
+					return nil, fmt.Errorf("messages[%d]: tool_result: %w", i, err)
+				}
+				messages = append(messages, Message{Role: "tool", ToolCallID: block.ToolUseID, Content: result})
+			default:
+				return nil, fmt.Errorf("messages[%d]: unsupported content block type %q", i, block.Type)
+			}
+		}
+		turn.Content = strings.Join(texts, "\n")
+		if turn.Content != "" || len(turn.ToolCalls) > 0 {
+			messages = append(messages, turn)
+		}
+	}
+
+	// Anthropic tooling names Claude models; those stand for the configured model, like gpt-4o
+	model := req.Model
+	if strings.HasPrefix(model, "claude") {
+		model = gpt4oModel
+	}
+	chat := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+		"stream":   req.Stream,
+	}
+	if req.Stream {
+		chat["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	if req.MaxTokens != nil {
+		chat["max_tokens"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		chat["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		chat["top_p"] = *req.TopP
+	}
+	if len(req.StopSequences) > 0 {
+		chat["stop"] = req.StopSequences
+	}
+	if req.Metadata.UserID != "" {
+		chat["user"] = req.Metadata.UserID
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]Tool, len(req.Tools))
+		for i, tool := range req.Tools {
+			tools[i] = Tool{Type: "function", Function: Function{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema}}
+		}
+		chat["tools"] = tools
+	}
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "auto", "none":
+			chat["tool_choice"] = req.ToolChoice.Type
+		case "any":
+			chat["tool_choice"] = "required"
+		case "tool":
+			chat["tool_choice"] = map[string]interface{}{"type": "function", "function": map[string]string{"name": req.ToolChoice.Name}}
+		}
+	}
+	return chat, nil
+}
+
+// anthropicStopReason maps an OpenAI finish reason onto Anthropic's stop_reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicToolInput returns tool call arguments as a JSON object for a tool_use block
+func anthropicToolInput(arguments string) json.RawMessage {
+	if strings.TrimSpace(arguments) == "" || !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// chatToAnthropic translates a chat completion into an Anthropic Messages response
+func chatToAnthropic(body []byte, model string) (AnthropicResponse, error) {
+	var completion struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return AnthropicResponse{}, err
+	}
+	resp := AnthropicResponse{
+		ID:         "msg_" + completion.ID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    []AnthropicBlock{},
+		StopReason: "end_turn",
+		Usage:      AnthropicUsage{InputTokens: completion.Usage.PromptTokens, OutputTokens: completion.Usage.CompletionTokens},
+	}
+	if len(completion.Choices) == 0 {
+		return resp, nil
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content != "" {
+		resp.Content = append(resp.Content, AnthropicBlock{Type: "text", Text: choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		resp.Content = append(resp.Content, AnthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: anthropicToolInput(call.Function.Arguments)})
+	}
+	resp.StopReason = anthropicStopReason(choice.FinishReason)
+	return resp, nil
+}
+
+// anthropicErrorType maps an HTTP status onto Anthropic's error types
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// anthropicError builds an Anthropic error body
+func anthropicError(errType, message string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+	return body
+}
+
+// writeAnthropicError answers with an Anthropic error body, taking the message from an
+// OpenAI error envelope when there is one
+func writeAnthropicError(w http.ResponseWriter, status int, body []byte) {
+	message := strings.TrimSpace(string(body))
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+		message = errResp.Error.Message
+	}
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(anthropicError(anthropicErrorType(status), message))
+}
+
+// handleAnthropicRequest serves POST /v1/messages by translating the Anthropic request into a
+// chat completion, running it through proxyHandler and translating the answer back
+func handleAnthropicRequest(w http.ResponseWriter, r *http.Request) {
+	var req AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error parsing Anthropic request: %v", err)
+		writeAnthropicError(w, http.StatusBadRequest, []byte("Request body must be an Anthropic Messages request"))
+		return
+	}
+	chat, err := anthropicToChat(req)
+	if err != nil {
+		log.Printf("Rejected Anthropic request: %v", err)
+		writeAnthropicError(w, http.StatusBadRequest, []byte(err.Error()))
+		return
+	}
+	body, err := json.Marshal(chat)
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, []byte("Error translating Anthropic request"))
+		return
+	}
+	log.Printf("Translated Anthropic Messages request (stream=%v)", req.Stream)
+
+	ctx := context.WithValue(context.WithValue(r.Context(), noStreamUpgradeKey{}, true), innerRequestKey{}, true)
+	sub, err := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, []byte("Error creating chat completion request"))
+		return
+	}
+	sub.Header = r.Header.Clone()
+	sub.Header.Del("Accept-Encoding")
+	sub.Header.Del("Content-Length")
+	sub.Header.Set("X-Request-ID", requestInfoFrom(r).requestID)
+	// The client key already moved to Authorization; Anthropic headers mean nothing upstream
+	sub.Header.Del("X-Api-Key")
+	for name := range sub.Header {
+		if strings.HasPrefix(name, "Anthropic-") {
+			sub.Header.Del(name)
+		}
+	}
+
+	out := &anthropicWriter{w: w, header: make(http.Header), model: req.Model}
+	proxyHandler(out, sub)
+	out.finish()
+}
+
+// anthropicWriter receives the chat completion response from proxyHandler and writes it to
+// the client in Anthropic's format: event streams are translated as they arrive, anything
+// else is buffered and translated once complete
+type anthropicWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	model  string
+
+	status    int
+	streaming bool
+	buf       bytes.Buffer // buffered body, or the incomplete last line of a stream
+
+	// Stream translation state
+	started    bool
+	done       bool
+	block      int    // index of the open content block; -1 before the first one
+	blockType  string // "text", "tool_use" or "" when no block is open
+	toolBlocks map[int]int
+	stopReason string
+	usage      Usage
+}
+
+func (a *anthropicWriter) Header() http.Header { return a.header }
+
+func (a *anthropicWriter) WriteHeader(status int) {
+	if a.status != 0 {
+		return
+	}
+	a.status = status
+	a.block = -1
+	if status != http.StatusOK || !strings.HasPrefix(a.header.Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	a.streaming = true
+	a.copyHeaders()
+	setStreamHeaders(a.w)
+	a.w.WriteHeader(http.StatusOK)
+}
+
+func (a *anthropicWriter) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	a.buf.Write(p)
+	if !a.streaming {
+		return len(p), nil
+	}
+	for {
+		line, err := a.buf.ReadBytes('\n')
+		if err != nil {
+			// Keep the partial line for the next write
+			a.buf.Reset()
+			a.buf.Write(line)
+			break
+		}
+		if err := a.translateLine(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (a *anthropicWriter) Flush() {
+	if f, ok := a.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// copyHeaders forwards the proxy's own headers, but not those describing the chat completion body
+func (a *anthropicWriter) copyHeaders() {
+	for k, v := range a.header {
+		switch k {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Vary":
+			continue
+		}
+		a.w.Header()[k] = v
+	}
+}
+
+// finish writes a buffered response once proxyHandler is done
+func (a *anthropicWriter) finish() {
+	if a.streaming {
+		return
+	}
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	a.copyHeaders()
+	if a.status != http.StatusOK {
+		writeAnthropicError(a.w, a.status, a.buf.Bytes())
+		return
+	}
+	resp, err := chatToAnthropic(a.buf.Bytes(), a.model)
+	if err != nil {
+		log.Printf("Error translating response to Anthropic format: %v", err)
+		writeAnthropicError(a.w, http.StatusBadGateway, []byte("Error translating upstream response"))
+		return
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		writeAnthropicError(a.w, http.StatusInternalServerError, []byte("Error encoding response"))
+		return
+	}
+	a.w.Header().Set("Content-Type", "application/json")
+	a.w.WriteHeader(http.StatusOK)
+	a.w.Write(body)
+}
+
+// event writes one Anthropic stream event
+func (a *anthropicWriter) event(name string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+// translateLine turns one line of the chat completion stream into Anthropic events
+func (a *anthropicWriter) translateLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if bytes.HasPrefix(line, []byte(":")) {
+		return a.event("ping", map[string]string{"type": "ping"})
+	}
+	payload, isData := sseData(line)
+	if !isData || a.done {
+		return nil
+	}
+	if bytes.Equal(payload, []byte("[DONE]")) {
+		return a.stop()
+	}
+
+	var chunk struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Delta struct {
+				Content   string `json:"content"`
+				ToolCalls []struct {
+					Index    int    `json:"index"`
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *Usage       `json:"usage"`
+		Error *ErrorDetail `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil
+	}
+	if chunk.Error != nil {
+		a.done = true
+		return a.event("error", map[string]interface{}{
+			"type":  "error",
+			"error": map[string]string{"type": "api_error", "message": chunk.Error.Message},
+		})
+	}
+	if err := a.start(chunk.ID); err != nil {
+		return err
+	}
+	if chunk.Usage != nil {
+		a.usage = *chunk.Usage
+	}
+	if len(chunk.Choices) == 0 {
+		return nil
+	}
+	choice := chunk.Choices[0]
+	if choice.Delta.Content != "" {
+		if a.blockType != "text" {
+			if err := a.openBlock(map[string]interface{}{"type": "text", "text": ""}, "text"); err != nil {
+				return err
+			}
+		}
+		if err := a.event("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": a.block,
+			"delta": map[string]string{"type": "text_delta", "text": choice.Delta.Content},
+		}); err != nil {
+			return err
+		}
+	}
+	for _, call := range choice.Delta.ToolCalls {
+		if _, seen := a.toolBlocks[call.Index]; !seen {
+			if err := a.openBlock(map[string]interface{}{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]interface{}{}}, "tool_use"); err != nil {
+				return err
+			}
+			if a.toolBlocks == nil {
+				a.toolBlocks = make(map[int]int)
+			}
+			a.toolBlocks[call.Index] = a.block
+		}
+		if call.Function.Arguments == "" {
+			continue
+		}
+		if err := a.event("content_block_delta", map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": a.toolBlocks[call.Index],
+			"delta": map[string]string{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+		}); err != nil {
+			return err
+		}
+	}
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		a.stopReason = anthropicStopReason(*choice.FinishReason)
+	}
+	return nil
+}
+
+// start sends message_start before the first content
+func (a *anthropicWriter) start(id string) error {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	return a.event("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":            "msg_" + id,
+			"type":          "message",
+			"role":          "assistant",
+			"model":         a.model,
+			"content":       []AnthropicBlock{},
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+			"usage":         AnthropicUsage{},
+		},
+	})
+}
+
+// openBlock closes the open content block and starts the next one
+func (a *anthropicWriter) openBlock(block map[string]interface{}, blockType string) error {
+	if err := a.closeBlock(); err != nil {
+		return err
+	}
+	a.block++
+	a.blockType = blockType
+	return a.event("content_block_start", map[string]interface{}{
+		"type":          "content_block_start",
+		"index":         a.block,
+		"content_block": block,
+	})
+}
+
+func (a *anthropicWriter) closeBlock() error {
+	if a.blockType == "" {
+		return nil
+	}
+	a.blockType = ""
+	return a.event("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": a.block})
+}
+
+// stop ends the message with its stop reason and usage
+func (a *anthropicWriter) stop() error {
+	a.done = true
+	if err := a.start(""); err != nil {
+		return err
+	}
+	if err := a.closeBlock(); err != nil {
+		return err
+	}
+	if a.stopReason == "" {
+		a.stopReason = "end_turn"
+	}
+	if err := a.event("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": a.stopReason, "stop_sequence": nil},
+		"usage": AnthropicUsage{InputTokens: a.usage.PromptTokens, OutputTokens: a.usage.CompletionTokens},
+	}); err != nil {
+		return err
+	}
+	return a.event("message_stop", map[string]string{"type": "message_stop"})
+}
+
+// setStreamHeaders sets the SSE response headers. Reverse proxies such as nginx must neither
+// buffer nor compress the stream, so both are switched off explicitly.
+func setStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Content-Encoding", "identity")
+	w.Header().Set("X-Accel-Buffering", "no")
+}
+
+func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, reissue upstreamRequester) {
+	debugLog("Starting streaming response handling")
+	debugLog("Response status: %d", resp.StatusCode)
+	debugLog("Response headers: %+v", resp.Header)
+
+	// Set headers for streaming response
+	setStreamHeaders(w)
+	w.WriteHeader(resp.StatusCode)
+
+	// Create a buffered reader for the response body
+	reader := bufio.NewReader(resp.Body)
+
+	// Create a context with cancel for cleanup
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// emit writes and flushes data; heartbeats run concurrently, so writes are serialized.
+	// With the batched strategy, data is flushed once STREAM_FLUSH_BYTES are pending or
+	// STREAM_FLUSH_INTERVAL_MS after the first pending write
+	var (
+		writeMu    sync.Mutex
+		pending    int
+		flushTimer *time.Timer
+	)
+	batched := requestInfoFrom(r).flush == flushBatched
+	flushLocked := func() {
+		pending = 0
+		if flushTimer != nil {
+			flushTimer.Stop()
+			flushTimer = nil
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		} else {
+			log.Printf("Warning: ResponseWriter does not support Flush")
+		}
+	}
+	emit := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if !batched {
+			flushLocked()
+			return nil
+		}
+		if pending += len(data); pending >= streamFlushBytes {
+			flushLocked()
+		} else if flushTimer == nil {
+			flushTimer = time.AfterFunc(streamFlushInterval, func() {
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				if pending > 0 && ctx.Err() == nil {
+					flushLocked()
+				}
+			})
+		}
+		return nil
+	}
+	// Send whatever a batched stream still holds once the handler is done
+	defer func() {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if pending > 0 {
+			flushLocked()
+		}
+	}()
+
+	// Tell reconnecting SSE clients how long to wait
+	if sseRetryMillis > 0 {
+		if err := emit([]byte(fmt.Sprintf("retry: %d\n\n", sseRetryMillis))); err != nil {
+			log.Printf("Error writing retry directive: %v", err)
+			return
+		}
+	}
+
+	// Start a goroutine to send heartbeats
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Send a heartbeat comment
+				if err := emit([]byte(": heartbeat\n\n")); err != nil {
+					log.Printf("Error sending heartbeat: %v", err)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		sent        strings.Builder // content already forwarded to the client
+		resumed     string          // forwarded content a resumed stream has yet to repeat
+		done        bool            // whether the upstream sent [DONE]
+		reconnected bool
+		transformer streamTransformer
+		eventID     int
+		lastChunk   streamChunk // identifies the stream in synthesized chunks
+		lastEmit    time.Time   // when the previous chunk was written, for STREAM_CHUNK_DELAY_MS
+
+		// With STREAM_EMPTY_RETRY, chunks without output are held back so an empty stream
+		// can be retried before the client has seen any of it
+		holding = flags().StreamEmptyRetry && reissue != nil
+		held    [][]byte
+	)
+
+	// release forwards the held-back chunks and stops holding
+	release := func() error {
+		holding = false
+		for _, line := range held {
+			if err := emit(line); err != nil {
+				return err
+			}
+		}
+		held = nil
+		return nil
+	}
+
+	info := requestInfoFrom(r)
+	transformer.model = info.requestedModel
+	transformer.legacyFunctions = info.legacyFunctions
+	defer func() {
+		// Estimate completion usage when the upstream did not report it
+		if info.usage.TotalTokens == 0 && sent.Len() > 0 {
+			info.estimateUsage(sent.Len())
+		}
+		if info.logPrompt {
+			logPromptRecord(info, sent.String())
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(r.Context().Err(), context.DeadlineExceeded) && !done {
+				finishTimedOutStream(emit, lastChunk)
+				return
+			}
+			log.Printf("Context cancelled, ending stream")
+			return
+		default:
+			line, err := readLine(reader, maxStreamLineBytes)
+			if err == errLineTooLong {
+				log.Printf("Upstream stream line exceeds %d bytes, terminating stream", maxStreamLineBytes)
+				if err := emit(sseErrorEvent("Upstream stream event exceeded the maximum size", "upstream_error")); err != nil {
+					log.Printf("Error writing to response: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				if done {
+					return
+				}
+				if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+					finishTimedOutStream(emit, lastChunk)
+					return
+				}
+				if err == io.EOF {
+					log.Printf("Upstream stream ended before [DONE]")
+				} else {
+					log.Printf("Error reading stream: %v", err)
+				}
+
+				// Best-effort recovery: re-issue the request once and skip the content already
+				// sent, provided the new stream repeats it
+				if flags().StreamReconnect && !reconnected && reissue != nil {
+					reconnected = true
+					newResp, err := reissue()
+					switch {
+					case err != nil:
+						log.Printf("Error reconnecting stream: %v", err)
+					case newResp.StatusCode >= 400:
+						log.Printf("Reconnect failed with status: %d", newResp.StatusCode)
+						newResp.Body.Close()
+					default:
+						log.Printf("Reconnected stream, skipping %d bytes of already-sent content", sent.Len())
+						defer newResp.Body.Close()
+						reader = bufio.NewReader(newResp.Body)
+						resumed = sent.String()
+						continue
+					}
+				}
+
+				// The client already has a 200, so report the failure in the stream itself
+				if r.Context().Err() == nil {
+					if err := emit(sseErrorEvent("The upstream stream ended unexpectedly", "upstream_error")); err != nil {
+						log.Printf("Error writing to response: %v", err)
+					}
+				}
+				return
+			}
+
+			// Skip empty lines
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			payload, isData := sseData(line)
+			// Forward data lines as "data: " even if the upstream left out the space
+			if isData && !bytes.HasPrefix(line, []byte("data: ")) {
+				line = dataLine(payload)
+			}
+			if isData && bytes.Equal(payload, []byte("[DONE]")) && resumed != "" {
+				log.Printf("Resumed stream ended before repeating the content already sent")
+				if err := emit(sseErrorEvent("The upstream stream could not be resumed", "upstream_error")); err != nil {
+					log.Printf("Error writing to response: %v", err)
+				}
+				return
+			}
+			if isData && bytes.Equal(payload, []byte("[DONE]")) {
+				// Nothing but empty chunks reached us: retry once, unseen by the client
+				if holding {
+					holding = false
+					log.Printf("Upstream stream ended without content, retrying once")
+					newResp, err := reissue()
+					if err == nil && newResp.StatusCode < 400 {
+						defer newResp.Body.Close()
+						reader = bufio.NewReader(newResp.Body)
+						held = nil
+						transformer = streamTransformer{model: info.requestedModel, legacyFunctions: info.legacyFunctions}
+						info.usage = Usage{}
+						continue
+					}
+					if err != nil {
+						log.Printf("Error retrying empty stream: %v", err)
+					} else {
+						log.Printf("Empty stream retry failed with status: %d", newResp.StatusCode)
+						newResp.Body.Close()
+					}
+					if err := release(); err != nil {
+						log.Printf("Error writing to response: %v", err)
+						cancel()
+						return
+					}
+				}
+				done = true
+
+				// Give clients that read a trailing usage object an estimate
+				if flags().StreamUsageChunk && info.usage.TotalTokens == 0 {
+					info.estimateUsage(sent.Len())
+					usageLine := dataLine(usageChunk(lastChunk, info.usage))
+					if flags().SSEEventIDs {
+						eventID++
+						usageLine = numberedEvent(eventID, usageLine)
+					}
+					if err := emit(usageLine); err != nil {
+						log.Printf("Error writing to response: %v", err)
+						cancel()
+						return
+					}
+				}
+			}
+
+			// Track forwarded content and drop what a resumed stream repeats
+			if isData && !done {
+				chunk := parseChunk(payload)
+				if chunk.Usage != nil {
+					info.usage = *chunk.Usage
+				}
+				if chunk.ID != "" {
+					lastChunk = chunk
+					if transformer.model != "" {
+						lastChunk.Model = transformer.model
+					}
+				}
+				content := chunk.content()
+				if resumed != "" && content != "" {
+					rest, ok := resumeContent(content, resumed)
+					if !ok {
+						log.Printf("Resumed stream differs from the content already sent, ending stream")
+						if err := emit(sseErrorEvent("The upstream stream could not be resumed", "upstream_error")); err != nil {
+							log.Printf("Error writing to response: %v", err)
+						}
+						return
+					}
+					resumed = resumed[len(content)-len(rest):]
+					// Role, tool call and finish chunks are forwarded even when their content was a repeat
+					if rest == "" && contentOnly(payload) {
+						continue
+					}
+					if rewritten, ok := rewriteChunkContent(payload, rest); ok {
+						content = rest
+						payload = rewritten
+						line = dataLine(rewritten)
+					}
+				}
+				sent.WriteString(content)
+
+				if rewritten, ok := transformer.transform(payload); ok {
+					line = dataLine(rewritten)
+				}
+			}
+
+			// Number events so clients can resume with Last-Event-ID
+			if flags().SSEEventIDs && isData {
+				eventID++
+				line = numberedEvent(eventID, line)
+			}
+
+			// Hold back chunks until the stream produces output
+			if holding && isData && !done {
+				if !chunkHasOutput(payload) {
+					held = append(held, line)
+					continue
+				}
+				if err := release(); err != nil {
+					log.Printf("Error writing to response: %v", err)
+					cancel()
+					return
+				}
+			}
+
+			// Pace chunks when a delay is configured
+			if isData && streamChunkDelay > 0 {
+				if err := paceChunk(ctx, streamChunkDelay, lastEmit); err != nil {
+					continue // the select above ends the stream
+				}
+				lastEmit = time.Now()
+			}
+
+			// Write the line to the response and flush it
+			if err := emit(line); err != nil {
+				log.Printf("Error writing to response: %v", err)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+var errLineTooLong = errors.New("stream line too long")
+
+// numberedEvent frames a data line as a complete SSE event carrying an id field. Unnumbered
+// streams leave out the blank line between events, but clients that track Last-Event-ID
+// parse events the way EventSource does and need it to dispatch each one.
+func numberedEvent(id int, line []byte) []byte {
+	event := append([]byte(fmt.Sprintf("id: %d\n", id)), line...)
+	return append(event, '\n')
+}
+
+// Stream flush strategies
+const (
+	flushImmediate = "immediate"
+	flushBatched   = "batched"
+)
+
+func validFlushStrategy(s string) bool {
+	return s == flushImmediate || s == flushBatched
+}
+
+// flushStrategy picks the stream flush strategy: the X-Stream-Flush header, then the
+// tenant's configured flush, then STREAM_FLUSH
+func flushStrategy(r *http.Request, cfg Config) string {
+	if h := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Stream-Flush"))); h != "" {
+		if validFlushStrategy(h) {
+			return h
+		}
+		requestInfoFrom(r).warn("X-Stream-Flush %q ignored (expected immediate or batched)", h)
+	}
+	if cfg.flush != "" {
+		return cfg.flush
+	}
+	return streamFlush
+}
+
+// Upper bound for STREAM_CHUNK_DELAY_MS, so a misconfiguration cannot stall streams
+const maxStreamChunkDelay = time.Second
+
+// paceChunk waits until delay has passed since the previous chunk, returning early with the
+// context's error when the client goes away
+func paceChunk(ctx context.Context, delay time.Duration, last time.Time) error {
+	if delay <= 0 || last.IsZero() {
+		return nil
+	}
+	wait := delay - time.Since(last)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readLine reads one newline-terminated line, failing with errLineTooLong once it exceeds max bytes
+// (0 disables the limit) instead of buffering it without bound
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if max > 0 && len(line)+len(fragment) > max {
+			return nil, errLineTooLong
+		}
+		line = append(line, fragment...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// upstreamErrorMessage extracts the message and type of an upstream error response, describing
+// a rejected upstream key as the proxy's configuration problem
+func upstreamErrorMessage(status int, body []byte) (string, string) {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return "The upstream provider rejected the proxy's API key. This is a proxy configuration problem, not an issue with your client key.", "upstream_auth_error"
+	}
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error.Message != "" {
+		errType := errResp.Error.Type
+		if errType == "" {
+			errType = "upstream_error"
+		}
+		return errResp.Error.Message, errType
+	}
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return truncateString(message, 1024), "upstream_error"
+	}
+	return http.StatusText(status), "upstream_error"
+}
+
+// writeStreamError answers a streaming request with a 200 stream holding only an error event
+func writeStreamError(w http.ResponseWriter, r *http.Request, message, errType string) {
+	setStreamHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(sseErrorEvent(localizeError(r, message), errType))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sseErrorEvent frames an error object followed by [DONE] to terminate a stream
+func sseErrorEvent(message, errType string) []byte {
+	payload, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Message: message, Type: errType}})
+	return append(dataLine(payload), "\ndata: [DONE]\n\n"...)
+}
+
+// finishTimedOutStream ends a stream whose STREAM_TIMEOUT_MS deadline fired with a final
+// length-limited chunk and [DONE], so clients keep the partial answer instead of an aborted stream
+func finishTimedOutStream(emit func([]byte) error, last streamChunk) {
+	log.Printf("Stream deadline exceeded, finishing stream with partial content")
+	final, _ := json.Marshal(map[string]interface{}{
+		"id":      last.ID,
+		"object":  "chat.completion.chunk",
+		"created": last.Created,
+		"model":   last.Model,
+		"choices": []map[string]interface{}{
+			{"index": 0, "delta": map[string]string{}, "finish_reason": "length"},
+		},
+	})
+	if err := emit(append(dataLine(final), "\ndata: [DONE]\n\n"...)); err != nil {
+		log.Printf("Error writing to response: %v", err)
+	}
+}
+
+// chunkHasOutput reports whether a streamed chunk carries content, reasoning or tool calls
+func chunkHasOutput(payload []byte) bool {
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content          string            `json:"content"`
+				ReasoningContent string            `json:"reasoning_content"`
+				ToolCalls        []json.RawMessage `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return true // forward anything the proxy does not understand
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" || choice.Delta.ReasoningContent != "" || len(choice.Delta.ToolCalls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// usageChunk builds a final chunk without choices that carries the stream's usage
+func usageChunk(last streamChunk, usage Usage) []byte {
+	chunk, _ := json.Marshal(map[string]interface{}{
+		"id":      last.ID,
+		"object":  "chat.completion.chunk",
+		"created": last.Created,
+		"model":   last.Model,
+		"choices": []interface{}{},
+		"usage":   usage,
+	})
+	return chunk
+}
+
+// sseData returns the payload of an SSE data line; as in the SSE spec, the space after
+// "data:" is optional
+func sseData(line []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(line)
+	if !bytes.HasPrefix(trimmed, []byte("data:")) {
+		return nil, false
+	}
+	return bytes.TrimSpace(trimmed[len("data:"):]), true
+}
+
+// streamChunk holds the parts of a streamed chunk the proxy inspects
+type streamChunk struct {
+	ID      string `json:"id"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// parseChunk decodes a streamed chunk, returning an empty chunk for invalid payloads
+func parseChunk(payload []byte) streamChunk {
+	var chunk streamChunk
+	json.Unmarshal(payload, &chunk)
+	return chunk
+}
+
+// content returns the delta content of the first choice
+func (c streamChunk) content() string {
+	if len(c.Choices) == 0 {
+		return ""
+	}
+	return c.Choices[0].Delta.Content
+}
+
+// resumeContent matches the content of a resumed stream's chunk against the forwarded content
+// it still has to repeat, returning whatever is new. It fails when the two differ or when the
+// repeated part would end inside a rune
+func resumeContent(content, pending string) (string, bool) {
+	n := len(content)
+	if n > len(pending) {
+		n = len(pending)
+	}
+	if content[:n] != pending[:n] || (n < len(content) && !utf8.RuneStart(content[n])) {
+		return "", false
+	}
+	return content[n:], true
+}
+
+// contentOnly reports whether a streamed chunk carries nothing but delta content, so it can be
+// dropped once that content is known to be a repeat
+func contentOnly(payload []byte) bool {
+	var chunk struct {
+		Choices []struct {
+			Delta        map[string]json.RawMessage `json:"delta"`
+			FinishReason *string                    `json:"finish_reason"`
+		} `json:"choices"`
+		Usage json.RawMessage `json:"usage"`
+	}
+	if err := json.Unmarshal(payload, &chunk); err != nil || len(chunk.Choices) == 0 || (len(chunk.Usage) > 0 && string(chunk.Usage) != "null") {
+		return false
+	}
+	for _, choice := range chunk.Choices {
+		if choice.FinishReason != nil {
+			return false
+		}
+		for key := range choice.Delta {
+			if key != "content" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rewriteChunk applies fn to every choice of a streamed chunk and, when model is set, renames
+// the chunk's model, re-encoding it if anything changed
+func rewriteChunk(payload []byte, model string, fn func(i int, choice map[string]interface{}) bool) ([]byte, bool) {
+	var chunk map[string]interface{}
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		return nil, false
+	}
+
+	changed := false
+	if current, ok := chunk["model"].(string); ok && model != "" && current != model {
+		chunk["model"] = model
+		changed = true
+	}
+	choices, _ := chunk["choices"].([]interface{})
+	for i, c := range choices {
+		if choice, ok := c.(map[string]interface{}); ok && fn(i, choice) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil, false
+	}
+
+	rewritten, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
+
+// rewriteChunkContent replaces the delta content of the first choice in a streamed chunk
+func rewriteChunkContent(payload []byte, content string) ([]byte, bool) {
+	return rewriteChunk(payload, "", func(i int, choice map[string]interface{}) bool {
+		delta, ok := choice["delta"].(map[string]interface{})
+		if i != 0 || !ok {
+			return false
+		}
+		delta["content"] = content
+		return true
+	})
+}
+
+// streamTransformer applies response normalizations to the chunks of one stream
+type streamTransformer struct {
+	sawRole bool
+
+	// Model name to report in every chunk (empty keeps the upstream's)
+	model string
+	// The request used the legacy functions field
+	legacyFunctions bool
+
+	// Tool call IDs by the index that introduced them, and indexes dropped as duplicates
+	toolIDs map[string]int
+	dropped map[int]bool
+}
+
+// transform rewrites a streamed chunk, reporting whether it changed
+func (t *streamTransformer) transform(payload []byte) ([]byte, bool) {
+	return rewriteChunk(payload, t.model, func(i int, choice map[string]interface{}) bool {
+		changed := false
+
+		if reason, ok := choice["finish_reason"].(string); ok {
+			if normalized := clientFinishReason(reason, t.legacyFunctions); normalized != reason {
+				choice["finish_reason"] = normalized
+				changed = true
+			}
+		}
+
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			return changed
+		}
+
+		// Clients expect the first delta to announce the assistant role
+		if _, hasRole := delta["role"]; hasRole {
+			t.sawRole = true
+		} else if !t.sawRole {
+			delta["role"] = "assistant"
+			t.sawRole = true
+			changed = true
+		}
+
+		// Frame tool call deltas the way OpenAI does: every entry carries an index,
+		// and the entry that introduces a call carries its type
+		if toolCalls, ok := delta["tool_calls"].([]interface{}); ok {
+			kept := toolCalls[:0]
+			for j, tc := range toolCalls {
+				call, ok := tc.(map[string]interface{})
+				if !ok {
+					kept = append(kept, tc)
+					continue
+				}
+				if _, hasIndex := call["index"]; !hasIndex {
+					call["index"] = j
+					changed = true
+				}
+				if _, hasID := call["id"]; hasID {
+					if _, hasType := call["type"]; !hasType {
+						call["type"] = "function"
+						changed = true
+					}
+				}
+				if t.checkToolCallID(call) {
+					changed = true
+				}
+				if t.dropped[toolCallIndex(call)] {
+					changed = true
+					continue
+				}
+				kept = append(kept, call)
+			}
+			if len(kept) > 0 {
+				delta["tool_calls"] = kept
+			} else {
+				delete(delta, "tool_calls")
+			}
+		}
+
+		return changed
+	})
+}
+
+// checkToolCallID applies DUPLICATE_TOOL_CALL_IDS to a streamed tool call entry that reuses
+// the ID of a call at another index, reporting whether the entry changed
+func (t *streamTransformer) checkToolCallID(call map[string]interface{}) bool {
+	id, _ := call["id"].(string)
+	if id == "" || duplicateToolCallIDs == "keep" {
+		return false
+	}
+	index := toolCallIndex(call)
+	if t.toolIDs == nil {
+		t.toolIDs = make(map[string]int)
+		t.dropped = make(map[int]bool)
+	}
+
+	owner, seen := t.toolIDs[id]
+	if !seen || owner == index {
+		t.toolIDs[id] = index
+		return false
+	}
+	if duplicateToolCallIDs == "dedupe" {
+		log.Printf("Dropping streamed tool call %d with duplicate ID %s", index, id)
+		t.dropped[index] = true
+		return true
+	}
+	unique := uniqueToolCallID(id, func(candidate string) bool {
+		_, taken := t.toolIDs[candidate]
+		return taken
+	})
+	log.Printf("Renaming duplicate streamed tool call ID %s to %s", id, unique)
+	t.toolIDs[unique] = index
+	call["id"] = unique
+	return true
+}
+
+// toolCallIndex returns the index of a decoded tool call entry, which the transformer may have set as an int
+func toolCallIndex(call map[string]interface{}) int {
+	switch v := call["index"].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// uniqueToolCallIDs applies DUPLICATE_TOOL_CALL_IDS to the tool calls of one message,
+// reporting whether anything changed
+func uniqueToolCallIDs(calls []ToolCall) ([]ToolCall, bool) {
+	if duplicateToolCallIDs == "keep" {
+		return calls, false
+	}
+	seen := make(map[string]bool, len(calls))
+	result := make([]ToolCall, 0, len(calls))
+	changed := false
+	for _, tc := range calls {
+		if tc.ID == "" || !seen[tc.ID] {
+			seen[tc.ID] = true
+			result = append(result, tc)
+			continue
+		}
+		changed = true
+		if duplicateToolCallIDs == "dedupe" {
+			log.Printf("Dropping tool call with duplicate ID %s", tc.ID)
+			continue
+		}
+		unique := uniqueToolCallID(tc.ID, func(candidate string) bool { return seen[candidate] })
+		log.Printf("Renaming duplicate tool call ID %s to %s", tc.ID, unique)
+		tc.ID = unique
+		seen[unique] = true
+		result = append(result, tc)
+	}
+	return result, changed
+}
+
+// uniqueToolCallID derives an ID from id that taken does not report as in use
+func uniqueToolCallID(id string, taken func(string) bool) string {
+	for n := 2; ; n++ {
+		if candidate := fmt.Sprintf("%s_%d", id, n); !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// dataLine frames a payload as an SSE data line
+func dataLine(payload []byte) []byte {
+	line := make([]byte, 0, len(payload)+7)
+	line = append(line, "data: "...)
+	line = append(line, payload...)
+	return append(line, '\n')
+}
+
+// openAIFinishReasons is the set of finish reasons OpenAI clients understand
+var openAIFinishReasons = map[string]bool{
+	"stop":           true,
+	"length":         true,
+	"tool_calls":     true,
+	"content_filter": true,
+	"function_call":  true,
+}
+
+// finishReasonMap maps provider-specific finish reasons onto the OpenAI set,
+// extended through FINISH_REASON_MAP (e.g. "eos=stop,max_output=length")
+var finishReasonMap = map[string]string{
+	"insufficient_system_resource": "length",
+}
+
+// normalizeFinishReason maps an upstream finish reason onto the OpenAI set
+func normalizeFinishReason(reason string) string {
+	if reason == "" || openAIFinishReasons[reason] {
+		return reason
+	}
+	if mapped, ok := finishReasonMap[reason]; ok {
+		return mapped
+	}
+	debugLog("Unknown finish reason %q normalized to stop", reason)
+	return "stop"
+}
+
+// clientFinishReason normalizes a finish reason and, for requests that used the legacy
+// functions field, reports tool calls as "function_call" as those clients expect
+func clientFinishReason(reason string, legacyFunctions bool) string {
+	reason = normalizeFinishReason(reason)
+	if reason == "tool_calls" && legacyFunctions && flags().LegacyFinishReason {
+		return "function_call"
+	}
+	return reason
+}
+
+// parseFinishReasonMap parses "from=to" pairs separated by commas into finishReasonMap
+func parseFinishReasonMap(spec string) {
+	for _, pair := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || from == "" || !openAIFinishReasons[to] {
+			if strings.TrimSpace(pair) != "" {
+				log.Printf("Ignoring invalid FINISH_REASON_MAP entry: %q", pair)
+			}
+			continue
+		}
+		finishReasonMap[from] = to
+	}
+}
+
+func handleRegularResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, reissue upstreamRequester) {
+	debugLog("Handling regular (non-streaming) response")
+	debugLog("Response status: %d", resp.StatusCode)
+	debugLog("Response headers: %+v", resp.Header)
+
+	// Read and log response body
+	body, err := readResponse(resp)
+	if err == errResponseTooLarge {
+		log.Printf("Upstream response exceeds %d bytes", maxResponseBytes)
+		writeOpenAIError(w, r, http.StatusBadGateway, fmt.Sprintf("Upstream response exceeded the proxy's limit of %d bytes", maxResponseBytes), "upstream_error")
+		return
+	}
+	if err != nil {
+		debugLog("Error reading response: %v", err)
+		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+		return
+	}
+
+	debugLog("Original response body: %s", logBody(body))
+
+	// Parse the DeepSeek response
+	var deepseekResp struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}
+
+	if err := json.Unmarshal(body, &deepseekResp); err != nil {
+		debugLog("Error parsing DeepSeek response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Some upstream responses (e.g. content filtering) carry no choices at all
+	if len(deepseekResp.Choices) == 0 {
+		log.Printf("Upstream response %s contained no choices", deepseekResp.ID)
+		if emptyChoicesMode == "error" {
+			writeOpenAIError(w, r, http.StatusBadGateway, "Upstream returned no choices (the response may have been filtered)", "upstream_error")
+			return
+		}
+		deepseekResp.Choices = append(deepseekResp.Choices, struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		}{
+			Message:      Message{Role: "assistant"},
+			FinishReason: "content_filter",
+		})
+	}
+
+	// JSON mode promises parseable content; retry once or flag answers that break it
+	if info := requestInfoFrom(r); info.jsonMode && jsonModeValidation != "off" {
+		valid := true
+		for _, choice := range deepseekResp.Choices {
+			if len(choice.Message.ToolCalls) == 0 && !json.Valid([]byte(choice.Message.Content)) {
+				valid = false
+			}
+		}
+		if !valid && jsonModeValidation == "retry" && reissue != nil {
+			log.Printf("Response %s is not valid JSON despite JSON mode, retrying once", deepseekResp.ID)
+			retryResp, err := reissue()
+			if err == nil && retryResp.StatusCode == http.StatusOK {
+				defer retryResp.Body.Close()
+				info.transformed("json-mode-retry")
+				handleRegularResponse(w, r, retryResp, nil)
+				return
+			}
+			if err != nil {
+				log.Printf("Error retrying invalid JSON response: %v", err)
+			} else {
+				log.Printf("JSON mode retry failed with status: %d", retryResp.StatusCode)
+				retryResp.Body.Close()
+			}
+		}
+		if !valid {
+			log.Printf("Response %s is not valid JSON despite JSON mode", deepseekResp.ID)
+			info.warn("response content is not valid JSON")
+			w.Header().Set("X-Proxy-Warnings", strings.Join(info.warnings, "; "))
+			w.Header().Set("X-JSON-Mode-Invalid", "true")
+		}
+	}
+
+	// Surface DeepSeek's context caching counters in OpenAI's format as well
+	usage := deepseekResp.Usage
+	requestInfoFrom(r).usage = usage
+	if usage.PromptCacheHitTokens > 0 || usage.PromptCacheMissTokens > 0 {
+		log.Printf("Prompt cache: %d hit tokens, %d miss tokens", usage.PromptCacheHitTokens, usage.PromptCacheMissTokens)
+		if usage.PromptTokensDetails == nil {
+			usage.PromptTokensDetails = &PromptTokensDetails{CachedTokens: usage.PromptCacheHitTokens}
+		}
+	}
+
+	if cost, ok := estimateCost(deepseekResp.Model, usage); ok {
+		log.Printf("Estimated cost for %s: $%.6f (%d prompt, %d completion tokens)", deepseekResp.Model, cost, usage.PromptTokens, usage.CompletionTokens)
+		if flags().CostHeader {
+			w.Header().Set("X-Estimated-Cost-USD", fmt.Sprintf("%.6f", cost))
+		}
+	}
+
+	// Convert to OpenAI format
+	openAIResp := struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+
+		// Base64 of the unconverted upstream body, only for X-Debug-Raw-Response
+		UpstreamRawResponse string `json:"upstream_raw_response,omitempty"`
+	}{
+		ID:      deepseekResp.ID,
+		Object:  "chat.completion",
+		Created: normalizeCreated(deepseekResp.Created, requestInfoFrom(r).receivedAt),
+		Model:   requestInfoFrom(r).requestedModel,
+		Usage:   usage,
+	}
+
+	openAIResp.Choices = make([]struct {
+		Index        int     `json:"index"`
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
+	}, len(deepseekResp.Choices))
+
+	if openAIResp.Created != deepseekResp.Created {
+		requestInfoFrom(r).transformed("created-normalize")
+	}
+	legacyFunctions := requestInfoFrom(r).legacyFunctions
+	for i, choice := range deepseekResp.Choices {
+		if clientFinishReason(choice.FinishReason, legacyFunctions) != choice.FinishReason {
+			requestInfoFrom(r).transformed("finish-reason-normalize")
+		}
+		openAIResp.Choices[i] = struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		}{
+			Index:        choice.Index,
+			Message:      choice.Message,
+			FinishReason: clientFinishReason(choice.FinishReason, legacyFunctions),
+		}
+
+		if len(choice.Message.ToolCalls) > 0 {
+			debugLog("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
+			openAIResp.Choices[i].Message.ToolCalls = nil
+			for j, tc := range choice.Message.ToolCalls {
+				debugLog("Tool call %d: %+v", j, tc)
+				if tc.Function.Name == "" {
+					debugLog("Warning: Empty function name in tool call %d", j)
+					requestInfoFrom(r).transformed("tool-call-filter")
+					continue
+				}
+				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
+			}
+			if calls, changed := uniqueToolCallIDs(openAIResp.Choices[i].Message.ToolCalls); changed {
+				openAIResp.Choices[i].Message.ToolCalls = calls
+				requestInfoFrom(r).transformed("tool-call-ids")
+			}
+		}
+
+		// Tool-call-only replies carry empty string content, or null as OpenAI's do when
+		// EMPTY_TOOL_CONTENT is off
+		if msg := &openAIResp.Choices[i].Message; len(msg.ToolCalls) > 0 && msg.Content == "" && !flags().EmptyToolContent {
+			msg.nullContent = true
+		}
+	}
+
+	// Flag tool calls whose arguments do not match the declared parameter schema
+	if flags().ValidateToolArguments {
+		var problems []string
+		for _, choice := range openAIResp.Choices {
+			problems = append(problems, validateToolCalls(choice.Message.ToolCalls, requestInfoFrom(r).toolSchemas)...)
+		}
+		if len(problems) > 0 {
+			log.Printf("Tool call validation failed: %s", strings.Join(problems, "; "))
+			w.Header().Set("X-Tool-Validation-Errors", strings.Join(problems, "; "))
+		}
+	}
+
+	modifiedBody, err := json.Marshal(openAIResp)
+	if err != nil {
+		debugLog("Error creating modified response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	debugLog("Modified response body: %s", logBody(modifiedBody))
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if info := requestInfoFrom(r); info.logPrompt {
+		var content string
+		if len(openAIResp.Choices) > 0 {
+			content = openAIResp.Choices[0].Message.Content
+		}
+		logPromptRecord(info, content)
+	}
+
+	if info := requestInfoFrom(r); info.idempotencyKey != "" {
+		cached := newCachedResponse(resp.StatusCode, w.Header(), modifiedBody)
+		cached.requestHash = info.requestHash
+		idempotencyCache.Set(info.idempotencyKey, cached)
+	}
+
+	// Added after caching so replays never carry the raw body
+	if requestInfoFrom(r).debugRawResponse {
+		openAIResp.UpstreamRawResponse = base64.StdEncoding.EncodeToString(body)
+		if withRaw, err := json.Marshal(openAIResp); err == nil {
+			modifiedBody = withRaw
+		}
+	}
+
+	setTransformsHeader(w, requestInfoFrom(r))
+	writeBody(w, r, resp.StatusCode, modifiedBody)
+	debugLog("Modified response sent successfully")
+}
+
+// cachedResponse is a complete non-streaming response kept for replay
+type cachedResponse struct {
+	status      int
+	header      http.Header
+	body        []byte
+	requestHash string
+}
+
+// newCachedResponse copies the response parts worth replaying
+func newCachedResponse(status int, header http.Header, body []byte) cachedResponse {
+	kept := make(http.Header)
+	for _, name := range []string{"Content-Type", "X-Estimated-Cost-USD", "X-Proxy-Warnings"} {
+		if v := header.Values(name); len(v) > 0 {
+			kept[name] = append([]string(nil), v...)
+		}
+	}
+	return cachedResponse{
+		status: status,
+		header: kept,
+		body:   append([]byte(nil), body...),
+	}
+}
+
+// Store is a key-value store with per-key expiry that backs the idempotency cache and token
+// quotas. The in-memory store is per process; a Redis store is shared by every replica.
+type Store interface {
+	// Get returns the live value stored under key
+	Get(key string) ([]byte, bool, error)
+	// Set stores value under key for ttl unless the key already holds a live value,
+	// reporting whether it was stored
+	Set(key string, value []byte, ttl time.Duration) (bool, error)
+	// Incr adds delta to the counter at key and returns the new count and the time left until
+	// the key expires; a missing key starts at zero and expires after ttl (0 never expires it)
+	Incr(key string, delta int64, ttl time.Duration) (int64, time.Duration, error)
+}
+
+var errStoreFull = errors.New("store is full")
+
+// Shared store for every feature when REDIS_URL is set (nil keeps each feature in memory)
+var redisBackend Store
+
+// newStore returns the shared Redis store, or a private in-memory store holding at most
+// maxEntries values (0 is unbounded)
+func newStore(maxEntries int) Store {
+	if redisBackend != nil {
+		return redisBackend
+	}
+	return newMemoryStore(maxEntries)
+}
+
+// storeKey builds a store key under prefix without putting client keys into the store as-is
+func storeKey(prefix, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return prefix + ":" + hex.EncodeToString(sum[:])
+}
+
+// memoryStore is the in-process Store
+type memoryStore struct {
+	mu         sync.Mutex
+	entries    map[string]storeEntry
+	maxEntries int
+}
+
+type storeEntry struct {
+	value   []byte
+	expires time.Time // zero for entries that never expire
+}
+
+func (e storeEntry) live(now time.Time) bool {
+	return e.expires.IsZero() || now.Before(e.expires)
+}
+
+func newMemoryStore(maxEntries int) *memoryStore {
+	return &memoryStore{entries: make(map[string]storeEntry), maxEntries: maxEntries}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !entry.live(time.Now()) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.entries[key]; ok && existing.live(now) {
+		return false, nil
+	}
+
+	// Drop expired entries before growing past the bound
+	if s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		for k, e := range s.entries {
+			if !e.live(now) {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= s.maxEntries {
+			return false, errStoreFull
+		}
+	}
+
+	entry := storeEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	s.entries[key] = entry
+	return true, nil
+}
+
+func (s *memoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := s.entries[key]
+	if !ok || !entry.live(now) {
+		entry = storeEntry{value: []byte("0")}
+		if ttl > 0 {
+			entry.expires = now.Add(ttl)
+		}
+	}
+	count, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("value at %s is not a counter", key)
+	}
+	count += delta
+	entry.value = []byte(strconv.FormatInt(count, 10))
+	s.entries[key] = entry
+
+	var left time.Duration
+	if !entry.expires.IsZero() {
+		left = entry.expires.Sub(now)
+	}
+	return count, left, nil
+}
+
+// redisStore is a Store on a Redis server, spoken to over RESP with a small connection pool
+type redisStore struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Increments a counter and starts its expiry on first use, in one round trip
+const redisIncrScript = `local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return {n, redis.call('PTTL', KEYS[1])}`
+
+// newRedisStore parses a redis:// or rediss:// URL with an optional password and database
+func newRedisStore(rawURL string) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	s := &redisStore{addr: u.Host, useTLS: u.Scheme == "rediss", idle: make(chan *redisConn, 16)}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.username, s.password = u.User.Username(), password
+		} else {
+			s.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	if s.useTLS {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs one command on a pooled connection, discarding connections that failed
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-s.idle:
+	default:
+		var err error
+		if rc, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// redisError is an error reply; the connection stays usable
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	var cmd bytes.Buffer
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write(cmd.Bytes()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply decodes one RESP reply: strings and bulk strings as []byte, integers as int64,
+// arrays as []interface{} and nil replies as nil
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (s *redisStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	return value, ok, nil
+}
+
+func (s *redisStore) Set(key string, value []byte, ttl time.Duration) (bool, error) {
+	args := []string{"SET", key, string(value), "NX"}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	reply, err := s.do(args...)
+	return reply != nil, err
+}
+
+func (s *redisStore) Incr(key string, delta int64, ttl time.Duration) (int64, time.Duration, error) {
+	reply, err := s.do("EVAL", redisIncrScript, "1", key, strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return 0, 0, errors.New("redis: unexpected INCRBY reply")
+	}
+	count, _ := items[0].(int64)
+	pttl, _ := items[1].(int64)
+	if pttl < 0 {
+		pttl = 0
+	}
+	return count, time.Duration(pttl) * time.Millisecond, nil
+}
+
+// QuotaStore tracks the tokens each client key used in its current quota window
+type QuotaStore interface {
+	// Used returns the tokens used in the current window and when the window resets
+	Used(key string, now time.Time) (int, time.Time)
+	// Add charges tokens to the key's current window, starting a new one if it expired
+	Add(key string, tokens int, now time.Time)
+}
+
+// storeQuota keeps fixed quota windows in a Store; a window starts with a key's first request
+type storeQuota struct {
+	store  Store
+	window time.Duration
+}
+
+func (q storeQuota) Used(key string, now time.Time) (int, time.Time) {
+	used, left, err := q.store.Incr(storeKey("quota", key), 0, q.window)
+	if err != nil {
+		log.Printf("Error reading token quota: %v", err)
+		return 0, now.Add(q.window)
+	}
+	return int(used), now.Add(left)
+}
+
+func (q storeQuota) Add(key string, tokens int, now time.Time) {
+	if _, _, err := q.store.Incr(storeKey("quota", key), int64(tokens), q.window); err != nil {
+		log.Printf("Error charging token quota: %v", err)
+	}
+}
+
+// responseCache stores responses in a Store for a fixed TTL. Flushing moves the cache to a
+// new generation of keys, so the old entries are never read again and simply expire.
+type responseCache struct {
+	store  Store
+	prefix string
+	ttl    time.Duration
+}
+
+func newResponseCache(store Store, prefix string, ttl time.Duration) *responseCache {
+	return &responseCache{store: store, prefix: prefix, ttl: ttl}
+}
+
+// cachedWire is the stored encoding of a cachedResponse
+type cachedWire struct {
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	RequestHash string      `json:"request_hash"`
+}
+
+// key returns the store key for a cache key in the current generation
+func (c *responseCache) key(key string) (string, error) {
+	generation, _, err := c.store.Incr(c.prefix+":generation", 0, 0)
+	if err != nil {
+		return "", err
+	}
+	return storeKey(c.prefix+":"+strconv.FormatInt(generation, 10), key), nil
+}
+
+// Get returns the unexpired response stored under key
+func (c *responseCache) Get(key string) (cachedResponse, bool) {
+	id, err := c.key(key)
+	if err != nil {
+		log.Printf("Error reading response cache: %v", err)
+		return cachedResponse{}, false
+	}
+	data, ok, err := c.store.Get(id)
+	if err != nil {
+		log.Printf("Error reading response cache: %v", err)
+	}
+	if !ok {
+		return cachedResponse{}, false
+	}
+	var entry cachedWire
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("Error decoding cached response: %v", err)
+		return cachedResponse{}, false
+	}
+	return cachedResponse{status: entry.Status, header: entry.Header, body: entry.Body, requestHash: entry.RequestHash}, true
+}
+
+// Set stores the first response for key; later responses for a live key are ignored
+func (c *responseCache) Set(key string, entry cachedResponse) {
+	id, err := c.key(key)
+	if err != nil {
+		log.Printf("Error writing response cache: %v", err)
+		return
+	}
+	data, err := json.Marshal(cachedWire{Status: entry.status, Header: entry.header, Body: entry.body, RequestHash: entry.requestHash})
+	if err != nil {
+		return
+	}
+	if _, err := c.store.Set(id, data, c.ttl); err == errStoreFull {
+		log.Printf("Response cache full, not storing response")
+	} else if err != nil {
+		log.Printf("Error writing response cache: %v", err)
+	}
+}
 
-	// Start a goroutine to send heartbeats
-	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send a heartbeat comment
-				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
-					log.Printf("Error sending heartbeat: %v", err)
-					cancel()
-					return
-				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+// Flush drops every entry
+func (c *responseCache) Flush() {
+	if _, _, err := c.store.Incr(c.prefix+":generation", 1, 0); err != nil {
+		log.Printf("Error flushing response cache: %v", err)
+	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Context cancelled, ending stream")
-			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				log.Printf("Error reading stream: %v", err)
-				cancel()
-				return
-			}
+// writeCachedResponse replays a stored response, flagging it with the given marker header
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, cached cachedResponse, marker string) {
+	for name, values := range cached.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(marker, "true")
+	writeBody(w, r, cached.status, cached.body)
+}
 
-			// Skip empty lines
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
-			}
+// upstreamURL maps a client request path onto the configured upstream endpoint
+func upstreamURL(cfg Config, path, rawQuery string) string {
+	if cfg.stripPrefix != "" && strings.HasPrefix(path, cfg.stripPrefix+"/") {
+		path = strings.TrimPrefix(path, cfg.stripPrefix)
+	}
 
-			// Write the line to the response
-			if _, err := w.Write(line); err != nil {
-				log.Printf("Error writing to response: %v", err)
-				cancel()
-				return
-			}
+	targetURL := strings.TrimSuffix(cfg.endpoint, "/") + path
+	if rawQuery != "" {
+		targetURL += "?" + rawQuery
+	}
+	return targetURL
+}
 
-			// Flush the response writer
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				log.Printf("Warning: ResponseWriter does not support Flush")
+// acceptsGzip reports whether the client advertised gzip support
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding := strings.TrimSpace(part)
+		if i := strings.Index(coding, ";"); i >= 0 {
+			if strings.TrimSpace(coding[i+1:]) == "q=0" {
+				continue
 			}
+			coding = strings.TrimSpace(coding[:i])
+		}
+		if strings.EqualFold(coding, "gzip") {
+			return true
 		}
 	}
+	return false
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response) {
-	debugLog("Handling regular (non-streaming) response")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
-
-	// Read and log response body
-	body, err := readResponse(resp)
-	if err != nil {
-		debugLog("Error reading response: %v", err)
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+// writeBody writes a complete (non-streaming) body, gzip-compressing it when the client accepts it
+func writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	if recordDir != "" {
+		requestInfoFrom(r).responseBody = body
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		w.WriteHeader(status)
+		w.Write(body)
 		return
 	}
 
-	debugLog("Original response body: %s", string(body))
+	buf := getBuffer(len(body))
+	defer putBuffer(buf)
 
-	// Parse the DeepSeek response
-	var deepseekResp struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(body); err != nil {
+		log.Printf("Error compressing response: %v", err)
+		w.WriteHeader(status)
+		w.Write(body)
+		return
 	}
-
-	if err := json.Unmarshal(body, &deepseekResp); err != nil {
-		debugLog("Error parsing DeepSeek response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := gz.Close(); err != nil {
+		log.Printf("Error compressing response: %v", err)
+		w.WriteHeader(status)
+		w.Write(body)
 		return
 	}
 
-	// Convert to OpenAI format
-	openAIResp := struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}{
-		ID:      deepseekResp.ID,
-		Object:  "chat.completion",
-		Created: deepseekResp.Created,
-		Model:   gpt4oModel,
-		Usage:   deepseekResp.Usage,
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// headersWithinLimits checks a header set against MAX_HEADER_COUNT and MAX_HEADER_BYTES
+func headersWithinLimits(h http.Header) bool {
+	count, size := 0, 0
+	for k, vv := range h {
+		for _, v := range vv {
+			count++
+			size += len(k) + len(v)
+		}
+	}
+	if maxHeaderCount > 0 && count > maxHeaderCount {
+		return false
+	}
+	if maxHeaderBytes > 0 && size > maxHeaderBytes {
+		return false
 	}
+	return true
+}
 
-	openAIResp.Choices = make([]struct {
-		Index        int     `json:"index"`
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	}, len(deepseekResp.Choices))
+// validateToolCalls checks tool call arguments against the parameter schemas of the
+// request's tools, returning one description per non-conforming call
+func validateToolCalls(toolCalls []ToolCall, schemas map[string]interface{}) []string {
+	var problems []string
+	compiled := make(map[string]*jsonschema.Schema)
+	for _, tc := range toolCalls {
+		schemaDoc, ok := schemas[tc.Function.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown tool %q", tc.ID, tc.Function.Name))
+			continue
+		}
+		if schemaDoc == nil {
+			continue
+		}
 
-	for i, choice := range deepseekResp.Choices {
-		openAIResp.Choices[i] = struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		}{
-			Index:        choice.Index,
-			Message:      choice.Message,
-			FinishReason: choice.FinishReason,
+		schema, ok := compiled[tc.Function.Name]
+		if !ok {
+			var err error
+			schema, err = compileToolSchema(tc.Function.Name, schemaDoc)
+			if err != nil {
+				log.Printf("Error compiling parameter schema for tool %s: %v", tc.Function.Name, err)
+				continue
+			}
+			compiled[tc.Function.Name] = schema
 		}
 
-		if len(choice.Message.ToolCalls) > 0 {
-			debugLog("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
-			for j, tc := range choice.Message.ToolCalls {
-				debugLog("Tool call %d: %+v", j, tc)
-				if tc.Function.Name == "" {
-					debugLog("Warning: Empty function name in tool call %d", j)
-					continue
-				}
-				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
+		var args interface{}
+		if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: arguments are not valid JSON", tc.ID))
+			continue
+		}
+		if err := schema.Validate(args); err != nil {
+			message := err.Error()
+			if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+				message = validationErrorSummary(validationErr)
 			}
+			problems = append(problems, fmt.Sprintf("%s: %s", tc.ID, message))
 		}
 	}
+	return problems
+}
 
-	modifiedBody, err := json.Marshal(openAIResp)
+// compileToolSchema compiles a tool's parameters document as a JSON schema
+func compileToolSchema(name string, doc interface{}) (*jsonschema.Schema, error) {
+	encoded, err := json.Marshal(doc)
 	if err != nil {
-		debugLog("Error creating modified response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	url := "tool://" + name + ".json"
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, bytes.NewReader(encoded)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
 
-	debugLog("Modified response body: %s", string(modifiedBody))
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(modifiedBody)
-	debugLog("Modified response sent successfully")
+// validationErrorSummary flattens a schema validation error into one line
+func validationErrorSummary(err *jsonschema.ValidationError) string {
+	leaf := err
+	for len(leaf.Causes) > 0 {
+		leaf = leaf.Causes[0]
+	}
+	location := leaf.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	return fmt.Sprintf("%s: %s", location, leaf.Message)
 }
 
 func copyHeaders(dst, src http.Header) {
 	skipHeaders := map[string]bool{
 		"Content-Length":    true,
 		"Content-Encoding":  true,
+		"Accept-Encoding":   true, // Let the transport negotiate upstream compression
+		"X-Upstream":        true, // Proxy-side upstream selection
+		"X-Stream-Flush":    true, // Proxy-side flush strategy
 		"Transfer-Encoding": true,
 		"Connection":        true,
 	}
@@ -751,6 +6434,140 @@ func copyHeaders(dst, src http.Header) {
 	}
 }
 
+// normalizeCreated ensures a response timestamp is a sane Unix seconds value
+func normalizeCreated(created int64, receivedAt time.Time) int64 {
+	if flags().CreatedFromProxy || created <= 0 {
+		return receivedAt.Unix()
+	}
+	// Some providers report milliseconds
+	if created > 1e11 {
+		return created / 1000
+	}
+	return created
+}
+
+// handleAdminRequest serves the operator endpoints; they are disabled unless ADMIN_TOKEN is set
+func handleAdminRequest(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	token, ok := parseBearer(r.Header.Get("Authorization"))
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("Rejected admin request to %s", r.URL.Path)
+		writeOpenAIError(w, r, http.StatusUnauthorized, "Invalid admin token", "authentication_error")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/cache/flush":
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeOpenAIError(w, r, http.StatusMethodNotAllowed, "Use POST to flush caches", "invalid_request_error")
+			return
+		}
+		flushed := []string{}
+		if idempotencyCache != nil {
+			idempotencyCache.Flush()
+			flushed = append(flushed, "idempotency")
+		}
+		log.Printf("Flushed caches: %v", flushed)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"flushed": flushed})
+	case "/admin/connections":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(connectionMetrics())
+	case "/admin/stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runtimeStats())
+	case "/admin/flags":
+		switch r.Method {
+		case "GET":
+		case "POST":
+			// Apply a partial update on a copy, so requests in flight keep a consistent view
+			updated := *flags()
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&updated); err != nil {
+				writeOpenAIError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid feature flags: %v", err), "invalid_request_error")
+				return
+			}
+			featureFlags.Store(&updated)
+			log.Printf("Feature flags updated: %+v", updated)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeOpenAIError(w, r, http.StatusMethodNotAllowed, "Use GET to view or POST to update feature flags", "invalid_request_error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flags())
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleHealthRequest reports that the proxy is up
+func handleHealthRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// handleEmbeddingsRequest forwards an embeddings request upstream with any stream field removed
+// and relays the JSON response
+func handleEmbeddingsRequest(w http.ResponseWriter, r *http.Request, cfg Config) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		debugLog("Error parsing embeddings request: %v", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, ok := fields["stream"]; ok {
+		log.Printf("Dropping stream from embeddings request")
+		delete(fields, "stream")
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Error creating embeddings request: %v", err)
+		http.Error(w, "Error creating request", http.StatusInternalServerError)
+		return
+	}
+
+	// Embeddings are bounded like other non-streaming requests
+	if completionTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), completionTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	proxyReq, err := newProxyRequest(r, cfg, upstreamURL(cfg, r.URL.Path, r.URL.RawQuery), body, false)
+	if err != nil {
+		log.Printf("Error creating proxy request: %v", err)
+		http.Error(w, "Error creating request", http.StatusInternalServerError)
+		return
+	}
+	resp, err := sendUpstream(cfg.name, proxyReq)
+	if err != nil {
+		log.Printf("Error forwarding request: %v", err)
+		http.Error(w, "Error forwarding request", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading embeddings response: %v", err)
+		http.Error(w, "Error reading response", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeBody(w, r, resp.StatusCode, respBody)
+}
+
 func handleModelsRequest(w http.ResponseWriter) {
 	debugLog("Handling models request")
 	response := ModelsResponse{
@@ -759,13 +6576,19 @@ func handleModelsRequest(w http.ResponseWriter) {
 			{
 				ID:      "gpt-4o",
 				Object:  "model",
-				Created: time.Now().Unix(),
+				Created: startTime.Unix(),
 				OwnedBy: "openai",
 			},
 			{
 				ID:      "deepseek-chat",
 				Object:  "model",
-				Created: time.Now().Unix(),
+				Created: startTime.Unix(),
+				OwnedBy: "deepseek",
+			},
+			{
+				ID:      "deepseek-reasoner",
+				Object:  "model",
+				Created: startTime.Unix(),
 				OwnedBy: "deepseek",
 			},
 		},
@@ -776,14 +6599,174 @@ func handleModelsRequest(w http.ResponseWriter) {
 	debugLog("Models response sent successfully")
 }
 
+// sensitiveFields lists JSON keys whose values are redacted from captured requests
+var sensitiveFields = map[string]bool{
+	"api_key":       true,
+	"apikey":        true,
+	"authorization": true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"access_token":  true,
+}
+
+// redactSecrets removes configured API keys and sensitive fields from a request body
+func redactSecrets(body []byte) []byte {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if redacted, err := json.Marshal(redactValue(payload)); err == nil {
+			body = redacted
+		}
+	}
+
+	for _, key := range []string{deepseekAPIKey, openRouterAPIKey} {
+		if key != "" {
+			body = bytes.ReplaceAll(body, []byte(key), []byte("[REDACTED]"))
+		}
+	}
+	return body
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if sensitiveFields[strings.ToLower(k)] {
+				v[k] = "[REDACTED]"
+				continue
+			}
+			v[k] = redactValue(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(child)
+		}
+	}
+	return value
+}
+
+// captureRequest writes a redacted copy of a raw request body to dir
+func captureRequest(dir string, body []byte) error {
+	seq := atomic.AddUint64(&captureSeq, 1)
+	name := fmt.Sprintf("%s-%06d.json", time.Now().UTC().Format("20060102T150405.000000000"), seq)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, redactSecrets(body), 0o600); err != nil {
+		return err
+	}
+	debugLog("Captured request body to %s", path)
+	return nil
+}
+
+// Recording is a redacted request/response pair written to RECORD_DIR
+type Recording struct {
+	Time            time.Time       `json:"time"`
+	Request         json.RawMessage `json:"request"`
+	UpstreamRequest json.RawMessage `json:"upstream_request"`
+	Status          int             `json:"status"`
+	Response        string          `json:"response"`
+}
+
+// recordExchange writes a redacted request/response pair to dir
+func recordExchange(dir string, info *requestInfo, status int, response []byte) error {
+	recording, err := json.MarshalIndent(Recording{
+		Time:            info.receivedAt,
+		Request:         redactSecrets(info.clientBody),
+		UpstreamRequest: redactSecrets(info.upstreamBody),
+		Status:          status,
+		Response:        string(redactSecrets(response)),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	seq := atomic.AddUint64(&captureSeq, 1)
+	name := fmt.Sprintf("%s-%06d.record.json", info.receivedAt.UTC().Format("20060102T150405.000000000"), seq)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, recording, 0o600); err != nil {
+		return err
+	}
+	debugLog("Recorded request %s to %s", info.requestID, path)
+	return nil
+}
+
+// loadReplay reads a capture or a recording, returning the client request body and, for
+// recordings, the upstream request the proxy sent for it
+func loadReplay(path string) (body, expected []byte, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading capture: %w", err)
+	}
+	var recording Recording
+	if json.Unmarshal(data, &recording) == nil && len(recording.Request) > 0 {
+		return recording.Request, recording.UpstreamRequest, nil
+	}
+	return data, nil, nil
+}
+
+// sameJSON reports whether two JSON documents are equal, ignoring formatting and field order
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// replayRequest runs a captured request body through the conversion pipeline and
+// writes the resulting upstream request to out without contacting the upstream.
+// Recordings from RECORD_DIR must convert to the upstream request they recorded
+func replayRequest(path string, out io.Writer) error {
+	body, expected, err := loadReplay(path)
+	if err != nil {
+		return err
+	}
+
+	var chatReq ChatRequest
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		return fmt.Errorf("error parsing capture: %w", err)
+	}
+
+	deepseekReq, err := buildDeepSeekRequest(chatReq, activeConfig)
+	if err != nil {
+		return fmt.Errorf("error converting capture: %w", err)
+	}
+	converted, err := json.MarshalIndent(deepseekReq, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding converted request: %w", err)
+	}
+
+	fmt.Fprintf(out, "%s\n", converted)
+	if expected != nil && !sameJSON(redactSecrets(converted), expected) {
+		return fmt.Errorf("converted request differs from the recorded upstream request")
+	}
+	return nil
+}
+
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// readResponse reads the whole upstream body, failing with errResponseTooLarge beyond
+// MAX_RESPONSE_BYTES (0 disables the limit)
 func readResponse(resp *http.Response) ([]byte, error) {
-	buf := getBuffer(int(resp.ContentLength))
+	// Content-Length only picks the pool; chunked bodies (-1) are read to EOF all the same
+	// and, of unknown size, start from the large pool
+	size := int(resp.ContentLength)
+	if size < 0 {
+		size = 1024
+	}
+	buf := getBuffer(size)
 	defer putBuffer(buf)
 
-	_, err := io.Copy(buf, resp.Body)
+	var body io.Reader = resp.Body
+	if maxResponseBytes > 0 {
+		body = io.LimitReader(resp.Body, int64(maxResponseBytes)+1)
+	}
+	_, err := io.Copy(buf, body)
 	if err != nil {
 		return nil, err
 	}
+	if maxResponseBytes > 0 && buf.Len() > maxResponseBytes {
+		return nil, errResponseTooLarge
+	}
 
-	return buf.Bytes(), nil
+	// The buffer goes back to the pool, so the caller gets its own copy
+	return append([]byte(nil), buf.Bytes()...), nil
 }